@@ -3,10 +3,10 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
-	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
@@ -60,69 +60,24 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 初回登録キャンペーンのクーポンを付与
-	_, err = tx.ExecContext(
-		ctx,
-		"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-		userID, "CP_NEW2024", 3000,
-	)
+	// 実施中のキャンペーンのクーポンを付与し、コミット後に通知する
+	grants, err := grantSignupCoupons(ctx, tx, userID, req.InvitationCode)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	// 招待コードを使った登録
-	if req.InvitationCode != nil && *req.InvitationCode != "" {
-		// 招待する側の招待数をチェック
-		var coupons []Coupon
-		err = tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE code = ? FOR UPDATE", "INV_"+*req.InvitationCode)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if len(coupons) >= 3 {
-			writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
-			return
-		}
-
-		// ユーザーチェック
-		var inviter User
-		err = tx.GetContext(ctx, &inviter, "SELECT * FROM users WHERE invitation_code = ?", *req.InvitationCode)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
-				return
-			}
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
-		// 招待クーポン付与
-		_, err = tx.ExecContext(
-			ctx,
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-			userID, "INV_"+*req.InvitationCode, 1500,
-		)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		// 招待した人にもRewardを付与
-		_, err = tx.ExecContext(
-			ctx,
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, CONCAT(?, '_', FLOOR(UNIX_TIMESTAMP(NOW(3))*1000)), ?)",
-			inviter.ID, "RWD_"+*req.InvitationCode, 1000,
-		)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
+		if errors.Is(err, errInvitationCodeUnavailable) {
+			writeError(w, http.StatusBadRequest, err)
 			return
 		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
 
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	for _, g := range grants {
+		couponGrantEvents.Publish(userTopic(g.UserID), g)
+	}
 
 	http.SetCookie(w, &http.Cookie{
 		Path:  "/",
@@ -138,8 +93,11 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 
 type appPostPaymentMethodsRequest struct {
 	Token string `json:"token"`
+	// 最初に登録した決済トークンは指定しなくても既定になる
+	IsDefault bool `json:"is_default"`
 }
 
+// appPostPaymentMethods は決済トークンを追加する。登録済みの決済トークンの場合は何もしない
 func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &appPostPaymentMethodsRequest{}
@@ -154,20 +112,175 @@ func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 
 	user := ctx.Value("user").(*User)
 
-	_, err := db.ExecContext(
-		ctx,
-		`INSERT INTO payment_tokens (user_id, token) VALUES (?, ?)`,
-		user.ID,
-		req.Token,
-	)
+	tx, err := db.Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	defer tx.Rollback()
+
+	// 既定の決済トークンが一つだけになるよう、利用者の決済トークンをロックしてから変更する
+	methods := []PaymentToken{}
+	if err := tx.SelectContext(ctx, &methods, `SELECT * FROM payment_tokens WHERE user_id = ? FOR UPDATE`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	methodID := ""
+	for _, m := range methods {
+		if m.Token == req.Token {
+			methodID = m.ID
+		}
+	}
+	if methodID == "" {
+		methodID = ulid.Make().String()
+		if _, err := tx.ExecContext(ctx, `INSERT INTO payment_tokens (id, user_id, token) VALUES (?, ?, ?)`, methodID, user.ID, req.Token); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if req.IsDefault || len(methods) == 0 {
+		if err := setDefaultPaymentMethod(ctx, tx, user.ID, methodID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 決済に失敗したライドは新しい決済トークンも使って決済し直す
+	if err := retryFailedPayments(ctx, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+type appGetPaymentMethodsResponse struct {
+	PaymentMethods []appGetPaymentMethodsResponseItem `json:"payment_methods"`
+}
+
+type appGetPaymentMethodsResponseItem struct {
+	ID string `json:"id"`
+	// 決済トークンは末尾4文字だけを返す
+	TokenLast4 string `json:"token_last4"`
+	IsDefault  bool   `json:"is_default"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+func appGetPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	methods := []PaymentToken{}
+	if err := db.SelectContext(ctx, &methods, `SELECT * FROM payment_tokens WHERE user_id = ? ORDER BY is_default DESC, created_at`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	items := make([]appGetPaymentMethodsResponseItem, 0, len(methods))
+	for _, m := range methods {
+		items = append(items, appGetPaymentMethodsResponseItem{
+			ID:         m.ID,
+			TokenLast4: m.Token[max(len(m.Token)-4, 0):],
+			IsDefault:  m.IsDefault,
+			CreatedAt:  m.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, &appGetPaymentMethodsResponse{
+		PaymentMethods: items,
+	})
+}
+
+// appDeletePaymentMethod は決済トークンを削除する。既定の決済トークンを削除した場合は最も古いものを既定にする
+func appDeletePaymentMethod(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+	methodID := r.PathValue("payment_method_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	methods := []PaymentToken{}
+	if err := tx.SelectContext(ctx, &methods, `SELECT * FROM payment_tokens WHERE user_id = ? ORDER BY created_at FOR UPDATE`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	idx := slices.IndexFunc(methods, func(m PaymentToken) bool { return m.ID == methodID })
+	if idx < 0 {
+		writeError(w, http.StatusNotFound, errors.New("payment method not found"))
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM payment_tokens WHERE id = ?`, methodID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	deleted := methods[idx]
+	methods = slices.Delete(methods, idx, idx+1)
+	if deleted.IsDefault && len(methods) > 0 {
+		if err := setDefaultPaymentMethod(ctx, tx, user.ID, methods[0].ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func appPostPaymentMethodDefault(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+	methodID := r.PathValue("payment_method_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	methods := []PaymentToken{}
+	if err := tx.SelectContext(ctx, &methods, `SELECT * FROM payment_tokens WHERE user_id = ? FOR UPDATE`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !slices.ContainsFunc(methods, func(m PaymentToken) bool { return m.ID == methodID }) {
+		writeError(w, http.StatusNotFound, errors.New("payment method not found"))
+		return
+	}
+
+	if err := setDefaultPaymentMethod(ctx, tx, user.ID, methodID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setDefaultPaymentMethod(ctx context.Context, tx *sqlx.Tx, userID string, methodID string) error {
+	_, err := tx.ExecContext(ctx, `UPDATE payment_tokens SET is_default = (id = ?) WHERE user_id = ?`, methodID, userID)
+	return err
+}
+
 type getAppRidesResponse struct {
 	Rides []getAppRidesResponseItem `json:"rides"`
 }
@@ -223,7 +336,7 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		fare, err := calculateDiscountedFareWithoutTx(ctx, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+		fare, err := calculateDiscountedFare(ctx, db, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
@@ -316,7 +429,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	user := ctx.Value("user").(*User)
 	rideID := ulid.Make().String()
 
-	tx, err := db.Beginx()
+	tx, err := beginRideTx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -336,7 +449,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if status != "COMPLETED" {
+		if !RideState(status).Finished() {
 			continuingRideCount++
 		}
 	}
@@ -356,80 +469,35 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := tx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "MATCHING",
-	); err != nil {
+	ride := Ride{}
+	if err := tx.GetContext(ctx, &ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	if _, err := tx.TransitionRide(ctx, &ride, RideStateMatching); err != nil {
+		writeError(w, rideStateErrorStatusCode(err), err)
+		return
+	}
+
 	var rideCount int
 	if err := tx.GetContext(ctx, &rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? `, user.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	var coupon Coupon
-	if rideCount == 1 {
-		// 初回利用で、初回利用クーポンがあれば必ず使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL FOR UPDATE", user.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-
-			// 無ければ他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			} else {
-				if _, err := tx.ExecContext(
-					ctx,
-					"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-					rideID, user.ID, coupon.Code,
-				); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			}
-		} else {
-			if _, err := tx.ExecContext(
-				ctx,
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = 'CP_NEW2024'",
-				rideID, user.ID,
-			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		}
-	} else {
-		// 他のクーポンを付与された順番に使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		} else {
-			if _, err := tx.ExecContext(
-				ctx,
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-				rideID, user.ID, coupon.Code,
-			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		}
-	}
-
-	ride := Ride{}
-	if err := tx.GetContext(ctx, &ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
+	// 使えるクーポンのうち優先度の高いものを使う。初回利用に限るクーポンは初回利用の場合だけ使える
+	coupon, err := findUsableCoupon(ctx, tx, user.ID, rideCount == 1, calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude), true)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if coupon != nil {
+		if _, err := redeemCoupon(ctx, tx.Tx, coupon, rideID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
 
 	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
 	if err != nil {
@@ -442,15 +510,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	eb.Publish(user.ID, RideStatusEventData{
-		Ride:   ride,
-		Status: "MATCHING",
-	})
-	eb.Publish(ride.ChairID.String, RideStatusEventData{
-		Ride:   ride,
-		UserID: user.ID,
-		Status: "MATCHING",
-	})
+	matcher.Trigger()
 
 	writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
 		RideID: rideID,
@@ -489,7 +549,7 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	// }
 	// defer tx.Rollback()
 
-	discounted, err := calculateDiscountedFareWithoutTx(ctx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	discounted, err := calculateDiscountedFare(ctx, db, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -539,7 +599,7 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tx, err := db.Beginx()
+	tx, err := beginRideTx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -555,27 +615,12 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	// status, err := getLatestRideStatus(ctx, tx, ride.ID)
-	// if err != nil {
-	// 	writeError(w, http.StatusInternalServerError, err)
-	// 	return
-	// }
 
-	id := ""
-	if err := tx.GetContext(ctx, &id, `SELECT id FROM ride_statuses WHERE ride_id = ? AND status = 'ARRIVED' ORDER BY created_at DESC LIMIT 1`, rideID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusBadRequest, errors.New("not arrived yet"))
-			return
-		}
-		writeError(w, http.StatusInternalServerError, err)
+	if _, err := tx.TransitionRide(ctx, ride, RideStateCompleted); err != nil {
+		writeError(w, rideStateErrorStatusCode(err), err)
 		return
 	}
 
-	// if status != "ARRIVED" {
-	// 	writeError(w, http.StatusBadRequest, errors.New("not arrived yet"))
-	// 	return
-	// }
-
 	result, err := tx.ExecContext(
 		ctx,
 		`UPDATE rides SET evaluation = ? WHERE id = ?`,
@@ -592,15 +637,6 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = tx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "COMPLETED")
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
 	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusNotFound, errors.New("ride not found"))
@@ -611,7 +647,7 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	paymentToken := &PaymentToken{}
-	if err := tx.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, ride.UserID); err != nil {
+	if err := tx.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ? ORDER BY is_default DESC, created_at LIMIT 1`, ride.UserID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusBadRequest, errors.New("payment token not registered"))
 			return
@@ -625,48 +661,126 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	paymentGatewayRequest := &paymentGatewayPostPaymentRequest{
-		Amount: fare,
+
+	// 決済はコミット後にワーカーが行い、結果は利用者の通知で知らせる
+	if err := enqueuePayment(ctx, tx.Tx, ride, fare); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
+	tx.AfterCommit(paymentQueue.Trigger)
 
-	// var paymentGatewayURL string
-	// if err := tx.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
-	// 	writeError(w, http.StatusInternalServerError, err)
-	// 	return
-	// }
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
+		CompletedAt: ride.UpdatedAt.UnixMilli(),
+	})
+}
+
+// 椅子が迎車に向かった後にキャンセルした場合はキャンセル料を徴収する
+const cancellationFee = initialFare
 
-	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() ([]Ride, error) {
-		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at ASC`, ride.UserID); err != nil {
+var errPaymentTokenNotRegistered = errors.New("payment token not registered")
+
+// cancelRide はライドをキャンセルし、使われていたクーポンを戻す
+// 椅子が迎車に向かった後であればキャンセル料の決済を積む
+func cancelRide(ctx context.Context, tx *rideTx, ride *Ride) (*RideCancellation, error) {
+	status, err := tx.TransitionRide(ctx, ride, RideStateCanceled)
+	if err != nil {
+		return nil, err
+	}
+
+	fee := 0
+	if status == RideStateEnroute || status == RideStatePickup {
+		fee = cancellationFee
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO ride_cancellations (ride_id, status, fee) VALUES (?, ?, ?)`, ride.ID, status, fee); err != nil {
+		return nil, err
+	}
+
+	// 使われなかったクーポンは次のライドで使えるように戻す
+	if err := releaseCoupon(ctx, tx.Tx, ride.ID); err != nil {
+		return nil, err
+	}
+
+	if fee > 0 {
+		paymentToken := &PaymentToken{}
+		if err := tx.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ? ORDER BY is_default DESC, created_at LIMIT 1`, ride.UserID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, errPaymentTokenNotRegistered
+			}
 			return nil, err
 		}
-		return rides, nil
-	}); err != nil {
-		if errors.Is(err, erroredUpstream) {
-			writeError(w, http.StatusBadGateway, err)
+
+		if err := enqueuePayment(ctx, tx.Tx, ride, fee); err != nil {
+			return nil, err
+		}
+		tx.AfterCommit(paymentQueue.Trigger)
+	}
+
+	cancellation := &RideCancellation{}
+	if err := tx.GetContext(ctx, cancellation, `SELECT * FROM ride_cancellations WHERE ride_id = ?`, ride.ID); err != nil {
+		return nil, err
+	}
+	return cancellation, nil
+}
+
+type appPostRideCancelResponse struct {
+	CancellationFee int   `json:"cancellation_fee"`
+	CanceledAt      int64 `json:"canceled_at"`
+}
+
+func appPostRideCancel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	user := ctx.Value("user").(*User)
+
+	tx, err := beginRideTx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
 			return
 		}
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if ride.UserID != user.ID {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
 
-	if err := tx.Commit(); err != nil {
+	cancellation, err := cancelRide(ctx, tx, ride)
+	if err != nil {
+		if code := rideStateErrorStatusCode(err); code != http.StatusInternalServerError {
+			writeError(w, code, err)
+			return
+		}
+		if errors.Is(err, errPaymentTokenNotRegistered) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	eb.Publish(ride.UserID, RideStatusEventData{
-		Ride:   *ride,
-		Status: "COMPLETED",
-	})
-	eb.Publish(ride.ChairID.String, RideStatusEventData{
-		Ride:   *ride,
-		UserID: ride.UserID,
-		Status: "COMPLETED",
-	})
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
-	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
-		CompletedAt: ride.UpdatedAt.UnixMilli(),
+	writeJSON(w, http.StatusOK, &appPostRideCancelResponse{
+		CancellationFee: cancellation.Fee,
+		CanceledAt:      cancellation.CreatedAt.UnixMilli(),
 	})
 }
 
@@ -698,87 +812,79 @@ type appGetNotificationResponseChairStats struct {
 	TotalEvaluationAvg float64 `json:"total_evaluation_avg"`
 }
 
+// SSE で利用者のライドの状態を通知する
+// 各イベントには ride_statuses の ID を id として付け、再接続時に Last-Event-ID が送られてきた場合は
+// それ以降の状態をDBから順に送り直す
+// 決済の結果は event: payment として別に送る
 func appGetNotificationWithSSE(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value("user").(*User)
 
-	ride := &Ride{}
-	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, user.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeJSON(w, http.StatusOK, &appGetNotificationResponse{
-				RetryAfterMs: 1000,
-			})
-			return
-		}
-		writeError(w, http.StatusInternalServerError, err)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	yetSentRideStatus := RideStatus{}
-	status := ""
-	if err := db.GetContext(ctx, &yetSentRideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? AND app_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`, ride.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			status, err = getLatestRideStatusWithoutTx(ctx, ride.ID)
-			if err != nil {
+	// 購読前に発生した通知を取りこぼさないよう、先に購読してからDBの分を送る
+	sub := rideStatusEvents.Subscribe(userTopic(user.ID))
+	defer sub.Unsubscribe()
+	paymentSub := paymentEvents.Subscribe(userTopic(user.ID))
+	defer paymentSub.Unsubscribe()
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+
+	var pending []RideStatus
+	if lastEventID != "" {
+		last := RideStatus{}
+		if err := db.GetContext(ctx, &last, `SELECT * FROM ride_statuses WHERE id = ?`, lastEventID); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
 				writeError(w, http.StatusInternalServerError, err)
 				return
 			}
+			// 知らないIDの場合は初回接続として扱う
+			lastEventID = ""
 		} else {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			query := `
+				SELECT rs.*
+				FROM ride_statuses rs
+				         INNER JOIN rides r ON r.id = rs.ride_id
+				WHERE r.user_id = ?
+				  AND (rs.created_at > ? OR (rs.created_at = ? AND rs.id > ?))
+				ORDER BY rs.created_at, rs.id
+			`
+			if err := db.SelectContext(ctx, &pending, query, user.ID, last.CreatedAt, last.CreatedAt, last.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
 		}
-	} else {
-		status = yetSentRideStatus.Status
 	}
 
-	fare, err := calculateDiscountedFareWithoutTx(ctx, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	data := &appGetNotificationResponseData{
-		RideID: ride.ID,
-		PickupCoordinate: Coordinate{
-			Latitude:  ride.PickupLatitude,
-			Longitude: ride.PickupLongitude,
-		},
-		DestinationCoordinate: Coordinate{
-			Latitude:  ride.DestinationLatitude,
-			Longitude: ride.DestinationLongitude,
-		},
-		Fare:      fare,
-		Status:    status,
-		CreatedAt: ride.CreatedAt.UnixMilli(),
-		UpdateAt:  ride.UpdatedAt.UnixMilli(),
-	}
-
-	if ride.ChairID.Valid {
-		chair := &Chair{}
-		if err := db.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
+	if lastEventID == "" {
+		ride := &Ride{}
+		if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, user.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeJSON(w, http.StatusOK, &appGetNotificationResponse{
+					RetryAfterMs: 1000,
+				})
+				return
+			}
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 
-		stats, err := getChairStatsWithoutTx(ctx, chair.ID)
-		if err != nil {
+		// 切断している間に進んだ状態を全て順に送る。全て送り済みの場合は最新の状態を送り直す
+		if err := db.SelectContext(ctx, &pending, `SELECT * FROM ride_statuses WHERE ride_id = ? AND app_sent_at IS NULL ORDER BY created_at ASC`, ride.ID); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-
-		data.Chair = &appGetNotificationResponseChair{
-			ID:    chair.ID,
-			Name:  chair.Name,
-			Model: chair.Model,
-			Stats: stats,
-		}
-	}
-
-	if yetSentRideStatus.ID != "" {
-		_, err := db.ExecContext(ctx, `UPDATE ride_statuses SET app_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, yetSentRideStatus.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+		if len(pending) == 0 {
+			rideStatus := RideStatus{}
+			if err := db.GetContext(ctx, &rideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1`, ride.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			pending = append(pending, rideStatus)
 		}
 	}
 
@@ -786,89 +892,162 @@ func appGetNotificationWithSSE(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
+	n := &appNotification{user: user}
+	sent := map[string]bool{}
+	send := func(ride *Ride, status RideState, rideStatusID string) error {
+		data, err := n.apply(ctx, ride, status)
+		if err != nil {
+			return err
+		}
+		if err := writeSSEEvent(w, rideStatusID, data); err != nil {
+			return err
+		}
+		flusher.Flush()
 
-	fmt.Fprintf(w, "data: %s\n", jsonData)
-	flusher.Flush()
+		if rideStatusID != "" {
+			sent[rideStatusID] = true
+			if _, err := db.ExecContext(ctx, `UPDATE ride_statuses SET app_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ? AND app_sent_at IS NULL`, rideStatusID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
-	// NOTE: SSE実装
-	ch := make(chan RideStatusEvent, 100)
-	eb.Subscribe(user.ID, ch)
+	rides := map[string]*Ride{}
+	for _, rs := range pending {
+		ride, ok := rides[rs.RideID]
+		if !ok {
+			ride = &Ride{}
+			if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rs.RideID); err != nil {
+				slog.Error("failed to get ride", slog.Any("err", err))
+				return
+			}
+			rides[rs.RideID] = ride
+		}
+		if err := send(ride, RideState(rs.Status), rs.ID); err != nil {
+			slog.Error("failed to send app notification", slog.Any("err", err))
+			return
+		}
+	}
 
 	for {
 		select {
-		case rse := <-ch:
-			switch rse.Data.Status {
-			case "MATCHING", "ENROUTE":
-				data.Status = rse.Data.Status
-				data.UpdateAt = rse.Data.Ride.UpdatedAt.UnixMilli()
-
-				if data.Chair == nil {
-					if rse.Data.Ride.ChairID.Valid {
-						chair := &Chair{}
-						if err := db.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, rse.Data.Ride.ChairID); err != nil {
-							writeError(w, http.StatusInternalServerError, err)
-							return
-						}
-
-						stats, err := getChairStatsWithoutTx(ctx, chair.ID)
-						if err != nil {
-							writeError(w, http.StatusInternalServerError, err)
-							return
-						}
-
-						data.Chair = &appGetNotificationResponseChair{
-							ID:    chair.ID,
-							Name:  chair.Name,
-							Model: chair.Model,
-							Stats: stats,
-						}
-					}
-				}
-			case "PICKUP", "CARRYING", "ARRIVED":
-				data.Status = rse.Data.Status
-				data.UpdateAt = rse.Data.Ride.UpdatedAt.UnixMilli()
-
-			case "COMPLETED":
-				data.Status = rse.Data.Status
-				data.UpdateAt = rse.Data.Ride.UpdatedAt.UnixMilli()
-
-				stats, err := getChairStatsWithoutTx(ctx, rse.Data.Ride.ChairID.String)
-				if err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-
-				data.Chair.Stats = stats
+		case rse, ok := <-sub.C:
+			// 遅い購読者として打ち切られた場合は接続を閉じ、再接続させる
+			if !ok {
+				return
 			}
-
-			jsonData, err := json.Marshal(data)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+			// DBから送った分と購読で受け取った分が重複することがある
+			if rse.Data.RideStatusID != "" && sent[rse.Data.RideStatusID] {
+				continue
+			}
+			ride := rse.Data.Ride
+			if err := send(&ride, rse.Data.Status, rse.Data.RideStatusID); err != nil {
+				slog.Error("failed to send app notification", slog.Any("err", err))
+				return
+			}
+		case pe, ok := <-paymentSub.C:
+			if !ok {
+				return
+			}
+			if err := writeNamedSSEEvent(w, "payment", "", newAppPaymentNotification(pe.Data)); err != nil {
+				slog.Error("failed to send app payment notification", slog.Any("err", err))
 				return
 			}
-			fmt.Fprintf(w, "data: %s\n", jsonData)
 			flusher.Flush()
-
-			// if rse.Data.Status == "COMPLETED" {
-			// 	return
-			// }
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// appPaymentNotification は決済の結果を知らせる payment イベント
+// status が PAYMENT_FAILED の場合は決済トークンを登録し直すと決済し直される
+type appPaymentNotification struct {
+	RideID string `json:"ride_id"`
+	Amount int    `json:"amount"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newAppPaymentNotification(data PaymentEventData) *appPaymentNotification {
+	return &appPaymentNotification{
+		RideID: data.RideID,
+		Amount: data.Amount,
+		Status: data.Status,
+		Error:  data.Error,
+	}
+}
+
+// appNotification は利用者へ送る通知の内容を保持し、状態の変化に合わせて更新する
+type appNotification struct {
+	user *User
+	data *appGetNotificationResponseData
+}
+
+func (n *appNotification) apply(ctx context.Context, ride *Ride, status RideState) (*appGetNotificationResponseData, error) {
+	// 別のライドに切り替わったら作り直す
+	if n.data == nil || n.data.RideID != ride.ID {
+		fare, err := calculateDiscountedFare(ctx, db, n.user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+		if err != nil {
+			return nil, err
+		}
+		n.data = &appGetNotificationResponseData{
+			RideID: ride.ID,
+			PickupCoordinate: Coordinate{
+				Latitude:  ride.PickupLatitude,
+				Longitude: ride.PickupLongitude,
+			},
+			DestinationCoordinate: Coordinate{
+				Latitude:  ride.DestinationLatitude,
+				Longitude: ride.DestinationLongitude,
+			},
+			Fare:      fare,
+			CreatedAt: ride.CreatedAt.UnixMilli(),
+		}
+	}
+
+	data := n.data
+	data.Status = string(status)
+	data.UpdateAt = ride.UpdatedAt.UnixMilli()
+
+	// 椅子に辞退された場合は割り当てが外れる
+	if !ride.ChairID.Valid {
+		data.Chair = nil
+		return data, nil
+	}
+
+	if data.Chair == nil || data.Chair.ID != ride.ChairID.String {
+		chair := &Chair{}
+		if err := db.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
+			return nil, err
+		}
+
+		stats, err := getChairStatsWithoutTx(ctx, chair.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		data.Chair = &appGetNotificationResponseChair{
+			ID:    chair.ID,
+			Name:  chair.Name,
+			Model: chair.Model,
+			Stats: stats,
+		}
+	} else if status == RideStateCompleted {
+		stats, err := getChairStatsWithoutTx(ctx, ride.ChairID.String)
+		if err != nil {
+			return nil, err
+		}
+		data.Chair.Stats = stats
+	}
+
+	return data, nil
+}
+
 func getChairStats(ctx context.Context, tx *sqlx.Tx, chairID string) (appGetNotificationResponseChairStats, error) {
 	stats := appGetNotificationResponseChairStats{}
 
@@ -1083,7 +1262,7 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 		for _, ride := range rides {
 			// 過去にライドが存在し、かつ、それが完了していない場合はスキップ
 			id := ""
-			if err := db.GetContext(ctx, &id, `SELECT id FROM ride_statuses WHERE ride_id = ? AND status = 'COMPLETED' ORDER BY created_at DESC LIMIT 1`, ride.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			if err := db.GetContext(ctx, &id, `SELECT id FROM ride_statuses WHERE ride_id = ? AND status IN ('COMPLETED', 'CANCELED') ORDER BY created_at DESC LIMIT 1`, ride.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 				writeError(w, http.StatusInternalServerError, err)
 				return
 			}
@@ -1114,94 +1293,3 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 		RetrievedAt: retrievedAt.UnixMilli(),
 	})
 }
-
-func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	return initialFare + meteredFare
-}
-
-func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
-	var coupon Coupon
-	discount := 0
-	if ride != nil {
-		destLatitude = ride.DestinationLatitude
-		destLongitude = ride.DestinationLongitude
-		pickupLatitude = ride.PickupLatitude
-		pickupLongitude = ride.PickupLongitude
-
-		// すでにクーポンが紐づいているならそれの割引額を参照
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-		} else {
-			discount = coupon.Discount
-		}
-	} else {
-		// 初回利用クーポンを最優先で使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-
-			// 無いなら他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					return 0, err
-				}
-			} else {
-				discount = coupon.Discount
-			}
-		} else {
-			discount = coupon.Discount
-		}
-	}
-
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
-
-	return initialFare + discountedMeteredFare, nil
-}
-
-func calculateDiscountedFareWithoutTx(ctx context.Context, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
-	var coupon Coupon
-	discount := 0
-	if ride != nil {
-		destLatitude = ride.DestinationLatitude
-		destLongitude = ride.DestinationLongitude
-		pickupLatitude = ride.PickupLatitude
-		pickupLongitude = ride.PickupLongitude
-
-		// すでにクーポンが紐づいているならそれの割引額を参照
-		if err := db.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-		} else {
-			discount = coupon.Discount
-		}
-	} else {
-		// 初回利用クーポンを最優先で使う
-		if err := db.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-
-			// 無いなら他のクーポンを付与された順番に使う
-			if err := db.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					return 0, err
-				}
-			} else {
-				discount = coupon.Discount
-			}
-		} else {
-			discount = coupon.Discount
-		}
-	}
-
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
-
-	return initialFare + discountedMeteredFare, nil
-}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// backgroundLoop は初期化のたびに停止・再起動するgoroutineを管理する
+type backgroundLoop struct {
+	// mu は cancel と done を保護する
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start は run をgoroutineで起動する。既に起動している場合は停止を待ってから起動し直す
+// run は ctx がキャンセルされたら戻らなければならない
+func (l *backgroundLoop) Start(run func(ctx context.Context)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stopLocked()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	l.cancel = cancel
+	l.done = done
+
+	go func() {
+		defer close(done)
+		run(ctx)
+	}()
+}
+
+// Stop はgoroutineを停止し、終了するまで待つ
+func (l *backgroundLoop) Stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stopLocked()
+}
+
+func (l *backgroundLoop) stopLocked() {
+	if l.cancel == nil {
+		return
+	}
+	l.cancel()
+	<-l.done
+	l.cancel = nil
+	l.done = nil
+}
+
+// triggeredLoop は一定間隔、または Trigger をきっかけに処理を実行するgoroutineを管理する
+type triggeredLoop struct {
+	backgroundLoop
+
+	// runMu は処理の同時実行を防ぐ。ループの外からも呼ばれる処理の中で取ること
+	runMu sync.Mutex
+
+	triggerOnce sync.Once
+	trigger     chan struct{}
+}
+
+// Start は interval ごと、または Trigger が呼ばれるたびに run を呼ぶgoroutineを起動する
+// 既に起動している場合は停止を待ってから起動し直す
+func (l *triggeredLoop) Start(interval time.Duration, run func(ctx context.Context)) {
+	l.backgroundLoop.Start(func(ctx context.Context) {
+		l.loop(ctx, interval, run)
+	})
+}
+
+// Trigger は次のティックを待たずに run を呼ばせる。呼び出し側はブロックしない
+func (l *triggeredLoop) Trigger() {
+	select {
+	case l.triggerChan() <- struct{}{}:
+	default:
+	}
+}
+
+func (l *triggeredLoop) triggerChan() chan struct{} {
+	l.triggerOnce.Do(func() {
+		l.trigger = make(chan struct{}, 1)
+	})
+	return l.trigger
+}
+
+// loop は ctx がキャンセルされるまで、interval ごと、または Trigger が呼ばれるたびに run を呼ぶ
+// 他のgoroutineと一緒に backgroundLoop で動かす場合は Start の代わりにこれを直接呼ぶ
+func (l *triggeredLoop) loop(ctx context.Context, interval time.Duration, run func(ctx context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-l.triggerChan():
+		}
+
+		run(ctx)
+	}
+}
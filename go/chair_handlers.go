@@ -4,7 +4,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/oklog/ulid/v2"
 )
@@ -88,6 +91,11 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 	}
 
 	chairByAccessToken.Delete(chair.AccessToken)
+	publishChairActivity(chair, req.IsActive)
+
+	if req.IsActive {
+		matcher.Trigger()
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -106,7 +114,7 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 
 	chair := ctx.Value("chair").(*Chair)
 
-	tx, err := db.Beginx()
+	tx, err := beginRideTx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -165,8 +173,6 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 	// 	return
 	// }
 
-	var newStatus string
-
 	ride := &Ride{}
 	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
@@ -179,23 +185,22 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if status != "COMPLETED" && status != "CANCELED" {
-			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "PICKUP"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-
-				newStatus = "PICKUP"
-			}
-
-			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ARRIVED"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
 
-				newStatus = "ARRIVED"
+		var next RideState
+		switch RideState(status) {
+		case RideStateEnroute:
+			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude {
+				next = RideStatePickup
+			}
+		case RideStateCarrying:
+			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude {
+				next = RideStateArrived
+			}
+		}
+		if next != "" {
+			if _, err := tx.TransitionRide(ctx, ride, next); err != nil {
+				writeError(w, rideStateErrorStatusCode(err), err)
+				return
 			}
 		}
 	}
@@ -204,18 +209,7 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-
-	if newStatus != "" {
-		eb.Publish(ride.UserID, RideStatusEventData{
-			Ride:   *ride,
-			Status: newStatus,
-		})
-		eb.Publish(chair.ID, RideStatusEventData{
-			Ride:   *ride,
-			UserID: ride.UserID,
-			Status: newStatus,
-		})
-	}
+	publishChairLocation(chair, *req, time.Now())
 
 	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
 		RecordedAt: latestChairLocation.CreatedAt.UnixMilli(),
@@ -240,7 +234,17 @@ type chairGetNotificationResponseData struct {
 	Status                string     `json:"status"`
 }
 
+// Accept: application/json が指定された場合は従来のポーリング形式で返し、それ以外は SSE で通知し続ける
 func chairGetNotification(w http.ResponseWriter, r *http.Request) {
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/event-stream") {
+		chairGetNotificationPolling(w, r)
+		return
+	}
+	chairGetNotificationWithSSE(w, r)
+}
+
+func chairGetNotificationPolling(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	chair := ctx.Value("chair").(*Chair)
 
@@ -300,27 +304,153 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 完了やキャンセルが椅子に通知された時点で椅子は空くので、待っているライドを割り当てさせる
+	if yetSentRideStatus.ID != "" && RideState(status).Finished() {
+		matcher.Trigger()
+	}
+
 	writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
-		Data: &chairGetNotificationResponseData{
-			RideID: ride.ID,
-			User: simpleUser{
-				ID:   user.ID,
-				Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
-			},
-			PickupCoordinate: Coordinate{
-				Latitude:  ride.PickupLatitude,
-				Longitude: ride.PickupLongitude,
-			},
-			DestinationCoordinate: Coordinate{
-				Latitude:  ride.DestinationLatitude,
-				Longitude: ride.DestinationLongitude,
-			},
-			Status: status,
-		},
+		Data:         newChairGetNotificationResponseData(ride, user, RideState(status)),
 		RetryAfterMs: 1000,
 	})
 }
 
+func chairGetNotificationWithSSE(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chair := ctx.Value("chair").(*Chair)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// 購読前に発生した通知を取りこぼさないよう、先に購読してからDBの未通知分を送る
+	sub := rideStatusEvents.Subscribe(chairTopic(chair.ID))
+	defer sub.Unsubscribe()
+
+	ride := &Ride{}
+	hasRide := true
+	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		hasRide = false
+	}
+
+	yetSentRideStatuses := []RideStatus{}
+	if hasRide {
+		if err := db.SelectContext(ctx, &yetSentRideStatuses, `SELECT * FROM ride_statuses WHERE ride_id = ? AND chair_sent_at IS NULL ORDER BY created_at ASC`, ride.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	users := map[string]*User{}
+	send := func(ride *Ride, status RideState, rideStatusID string) error {
+		user, ok := users[ride.UserID]
+		if !ok {
+			user = &User{}
+			if err := db.GetContext(ctx, user, "SELECT * FROM users WHERE id = ?", ride.UserID); err != nil {
+				return err
+			}
+			users[ride.UserID] = user
+		}
+
+		if err := writeSSEEvent(w, "", newChairGetNotificationResponseData(ride, user, status)); err != nil {
+			return err
+		}
+		flusher.Flush()
+
+		// 実際に送り出したタイミングを椅子への通知日時として記録する
+		if rideStatusID != "" {
+			if _, err := db.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ? AND chair_sent_at IS NULL`, rideStatusID); err != nil {
+				return err
+			}
+			if status.Finished() {
+				matcher.Trigger()
+			}
+		}
+		return nil
+	}
+
+	sent := map[string]bool{}
+	if hasRide {
+		if len(yetSentRideStatuses) == 0 {
+			status, err := getLatestRideStatusWithoutTx(ctx, ride.ID)
+			if err != nil {
+				slog.Error("failed to get latest ride status", slog.Any("err", err))
+				return
+			}
+			if err := send(ride, RideState(status), ""); err != nil {
+				slog.Error("failed to send chair notification", slog.Any("err", err))
+				return
+			}
+		}
+		for _, rs := range yetSentRideStatuses {
+			if err := send(ride, RideState(rs.Status), rs.ID); err != nil {
+				slog.Error("failed to send chair notification", slog.Any("err", err))
+				return
+			}
+			sent[rs.ID] = true
+		}
+	}
+
+	for {
+		select {
+		case rse, ok := <-sub.C:
+			// 遅い購読者として打ち切られた場合は接続を閉じ、再接続させる
+			if !ok {
+				return
+			}
+			// DBから送った分と購読で受け取った分が重複することがある
+			if rse.Data.RideStatusID != "" && sent[rse.Data.RideStatusID] {
+				continue
+			}
+			ride := rse.Data.Ride
+			if err := send(&ride, rse.Data.Status, rse.Data.RideStatusID); err != nil {
+				slog.Error("failed to send chair notification", slog.Any("err", err))
+				return
+			}
+			if rse.Data.RideStatusID != "" {
+				sent[rse.Data.RideStatusID] = true
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func newChairGetNotificationResponseData(ride *Ride, user *User, status RideState) *chairGetNotificationResponseData {
+	return &chairGetNotificationResponseData{
+		RideID: ride.ID,
+		User: simpleUser{
+			ID:   user.ID,
+			Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
+		},
+		PickupCoordinate: Coordinate{
+			Latitude:  ride.PickupLatitude,
+			Longitude: ride.PickupLongitude,
+		},
+		DestinationCoordinate: Coordinate{
+			Latitude:  ride.DestinationLatitude,
+			Longitude: ride.DestinationLongitude,
+		},
+		Status: string(status),
+	}
+}
+
+// 迎車位置に到着してからこの時間が経っても乗車されなければ、椅子は乗車拒否(NO_SHOW)として報告できる
+const noShowTimeout = 3 * time.Minute
+
 type postChairRidesRideIDStatusRequest struct {
 	Status string `json:"status"`
 }
@@ -337,7 +467,7 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tx, err := db.Beginx()
+	tx, err := beginRideTx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -362,37 +492,66 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 	switch req.Status {
 	// Acknowledge the ride
 	case "ENROUTE":
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
+		if _, err := tx.TransitionRide(ctx, ride, RideStateEnroute); err != nil {
+			writeError(w, rideStateErrorStatusCode(err), err)
+			return
+		}
+	// After Picking up user
+	case "CARRYING":
+		if _, err := tx.TransitionRide(ctx, ride, RideStateCarrying); err != nil {
+			writeError(w, rideStateErrorStatusCode(err), err)
+			return
+		}
+	// Decline the assigned ride and put it back to the matching pool
+	case "DECLINED":
+		if _, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = NULL WHERE id = ?", ride.ID); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if status != "MATCHING" {
-			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
+		if err := tx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ?", ride.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ENROUTE"); err != nil {
+		// 次に割り当てられる椅子へ改めて通知されるよう MATCHING を積み直す
+		if _, err := tx.TransitionRide(ctx, ride, RideStateMatching); err != nil {
+			writeError(w, rideStateErrorStatusCode(err), err)
+			return
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_rejections (ride_id, chair_id) VALUES (?, ?)", ride.ID, chair.ID); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-	// After Picking up user
-	case "CARRYING":
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
+	// The rider did not show up at the pickup point
+	case "NO_SHOW":
+		rideStatus := RideStatus{}
+		if err := tx.GetContext(ctx, &rideStatus, "SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1", ride.ID); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if status != "PICKUP" {
-			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
+		if RideState(rideStatus.Status) != RideStatePickup {
+			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived at the pickup point"))
+			return
+		}
+		if time.Since(rideStatus.CreatedAt) < noShowTimeout {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("no-show can be reported %s after arrival", noShowTimeout))
 			return
 		}
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "CARRYING"); err != nil {
+		if _, err := cancelRide(ctx, tx, ride); err != nil {
+			if code := rideStateErrorStatusCode(err); code != http.StatusInternalServerError {
+				writeError(w, code, err)
+				return
+			}
+			if errors.Is(err, errPaymentTokenNotRegistered) {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 
 	default:
 		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
+		return
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -400,16 +559,8 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Status == "ENROUTE" || req.Status == "CARRYING" {
-		eb.Publish(ride.UserID, RideStatusEventData{
-			Ride:   *ride,
-			Status: req.Status,
-		})
-		eb.Publish(chair.ID, RideStatusEventData{
-			Ride:   *ride,
-			UserID: ride.UserID,
-			Status: req.Status,
-		})
+	if req.Status == "DECLINED" {
+		matcher.Trigger()
 	}
 
 	w.WriteHeader(http.StatusNoContent)
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// CouponGrantOnSignup のキャンペーンは登録した利用者にプレフィックスそのものをコードとするクーポンを付与する
+	CouponGrantOnSignup = "SIGNUP"
+	// CouponGrantOnInvitation のキャンペーンは招待コードを使って登録した利用者に「プレフィックス+招待コード」のクーポンを付与する
+	CouponGrantOnInvitation = "INVITATION"
+	// CouponGrantOnInviterReward のキャンペーンは招待した利用者に「プレフィックス+招待コード_登録日時」のクーポンを付与する
+	CouponGrantOnInviterReward = "INVITER_REWARD"
+
+	CouponEligibilityAnyRide       = "ANY_RIDE"
+	CouponEligibilityFirstRideOnly = "FIRST_RIDE_ONLY"
+)
+
+// クーポンはコードのプレフィックスでキャンペーンに対応づける
+// キャンペーンの期間外のクーポンや、利用回数の上限に達したキャンペーンのクーポンは使えない
+const (
+	couponCampaignJoin            = `JOIN coupon_campaigns ON LEFT(coupons.code, CHAR_LENGTH(coupon_campaigns.code_prefix)) = coupon_campaigns.code_prefix`
+	activeCouponCampaignCondition = `(coupon_campaigns.starts_at IS NULL OR coupon_campaigns.starts_at <= NOW(6)) AND (coupon_campaigns.ends_at IS NULL OR coupon_campaigns.ends_at > NOW(6))`
+)
+
+var errInvitationCodeUnavailable = errors.New("この招待コードは使用できません。")
+
+func getActiveCouponCampaigns(ctx context.Context, tx *sqlx.Tx, grantOn string) ([]CouponCampaign, error) {
+	campaigns := []CouponCampaign{}
+	err := tx.SelectContext(ctx, &campaigns, `SELECT * FROM coupon_campaigns WHERE grant_on = ? AND `+activeCouponCampaignCondition+` ORDER BY created_at`, grantOn)
+	return campaigns, err
+}
+
+// grantSignupCoupons は登録した利用者と、招待コードを使った場合は招待した利用者に、実施中のキャンペーンのクーポンを付与する
+func grantSignupCoupons(ctx context.Context, tx *sqlx.Tx, userID string, invitationCode *string) ([]CouponGrantEventData, error) {
+	grants := []CouponGrantEventData{}
+	// 割引の内容は付与した時点のキャンペーンのものを使う
+	grant := func(userID, code string, c *CouponCampaign) error {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO coupons (user_id, code, discount, discount_type, max_discount, min_fare, applies_to) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			userID, code, c.Discount, c.DiscountType, c.MaxDiscount, c.MinFare, c.AppliesTo,
+		); err != nil {
+			return err
+		}
+		grants = append(grants, CouponGrantEventData{UserID: userID, Code: code, Discount: c.Discount, DiscountType: c.DiscountType})
+		return nil
+	}
+
+	campaigns, err := getActiveCouponCampaigns(ctx, tx, CouponGrantOnSignup)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range campaigns {
+		if err := grant(userID, c.CodePrefix, &c); err != nil {
+			return nil, err
+		}
+	}
+
+	if invitationCode == nil || *invitationCode == "" {
+		return grants, nil
+	}
+
+	// 招待コードごとの付与数の上限をチェック
+	invitationCampaigns, err := getActiveCouponCampaigns(ctx, tx, CouponGrantOnInvitation)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range invitationCampaigns {
+		if !c.MaxGrantsPerCode.Valid {
+			continue
+		}
+		var coupons []Coupon
+		if err := tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE code = ? FOR UPDATE", c.CodePrefix+*invitationCode); err != nil {
+			return nil, err
+		}
+		if int64(len(coupons)) >= c.MaxGrantsPerCode.Int64 {
+			return nil, errInvitationCodeUnavailable
+		}
+	}
+
+	// ユーザーチェック
+	var inviter User
+	if err := tx.GetContext(ctx, &inviter, "SELECT * FROM users WHERE invitation_code = ?", *invitationCode); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errInvitationCodeUnavailable
+		}
+		return nil, err
+	}
+
+	for _, c := range invitationCampaigns {
+		if err := grant(userID, c.CodePrefix+*invitationCode, &c); err != nil {
+			return nil, err
+		}
+	}
+
+	// 招待した人にもRewardを付与
+	rewardCampaigns, err := getActiveCouponCampaigns(ctx, tx, CouponGrantOnInviterReward)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range rewardCampaigns {
+		code := fmt.Sprintf("%s%s_%d", c.CodePrefix, *invitationCode, time.Now().UnixMilli())
+		if err := grant(inviter.ID, code, &c); err != nil {
+			return nil, err
+		}
+	}
+
+	return grants, nil
+}
+
+// findUsableCoupon は利用者が次のライドで使えるクーポンのうち、キャンペーンの優先度が高く、付与されたのが古いものを返す
+// 使えるクーポンがない場合は nil を返す。firstRide は次のライドが利用者の初めてのライドかどうか、fare は割引前の運賃
+func findUsableCoupon(ctx context.Context, q sqlx.QueryerContext, userID string, firstRide bool, fare int, forUpdate bool) (*Coupon, error) {
+	query := `
+		SELECT coupons.*
+		FROM coupons
+		` + couponCampaignJoin + `
+		WHERE coupons.user_id = ?
+		  AND coupons.used_by IS NULL
+		  AND (coupons.min_fare IS NULL OR coupons.min_fare <= ?)
+		  AND ` + activeCouponCampaignCondition + `
+		  AND (coupon_campaigns.eligibility = ? OR ?)
+		  AND (coupon_campaigns.max_redemptions IS NULL OR coupon_campaigns.redemptions < coupon_campaigns.max_redemptions)
+		ORDER BY coupon_campaigns.priority DESC, coupons.created_at
+		LIMIT 1`
+	if forUpdate {
+		query += ` FOR UPDATE OF coupons`
+	}
+
+	coupon := &Coupon{}
+	if err := sqlx.GetContext(ctx, q, coupon, query, userID, fare, CouponEligibilityAnyRide, firstRide); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return coupon, nil
+}
+
+// redeemCoupon はクーポンをライドに使う。キャンペーンの利用回数が上限に達していた場合は使わずに false を返す
+func redeemCoupon(ctx context.Context, tx *sqlx.Tx, coupon *Coupon, rideID string) (bool, error) {
+	result, err := tx.ExecContext(ctx,
+		`UPDATE coupon_campaigns SET redemptions = redemptions + 1 WHERE LEFT(?, CHAR_LENGTH(code_prefix)) = code_prefix AND (max_redemptions IS NULL OR redemptions < max_redemptions)`,
+		coupon.Code,
+	)
+	if err != nil {
+		return false, err
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return false, err
+	} else if count == 0 {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?", rideID, coupon.UserID, coupon.Code); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// releaseCoupon はライドに使われていたクーポンを次のライドで使えるように戻す
+func releaseCoupon(ctx context.Context, tx *sqlx.Tx, rideID string) error {
+	coupon := &Coupon{}
+	if err := tx.GetContext(ctx, coupon, `SELECT * FROM coupons WHERE used_by = ? FOR UPDATE`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE coupon_campaigns SET redemptions = redemptions - 1 WHERE LEFT(?, CHAR_LENGTH(code_prefix)) = code_prefix AND redemptions > 0`,
+		coupon.Code,
+	); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `UPDATE coupons SET used_by = NULL WHERE used_by = ?`, rideID)
+	return err
+}
@@ -1,61 +1,268 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
-type RideStatusEventData struct {
-	Ride   Ride
-	UserID string
-	Status string
-}
-
-type RideStatusEvent struct {
-	Data  RideStatusEventData
+// Event は EventBus に流れるイベント。Topic は "user:{id}" のような発生元を表す
+type Event[T any] struct {
+	Data  T
 	Topic string
 }
 
-type RideStatusChannel chan RideStatusEvent
+// SlowSubscriberPolicy はバッファが一杯の購読者にイベントを送ろうとした時の振る舞い
+type SlowSubscriberPolicy string
+
+const (
+	// SlowSubscriberDrop はそのイベントを捨てて購読は続ける
+	SlowSubscriberDrop SlowSubscriberPolicy = "drop"
+	// SlowSubscriberDisconnect は購読を打ち切ってチャネルを閉じる
+	// SSE であればクライアントが Last-Event-ID 付きで再接続して取りこぼしを取り戻せる
+	SlowSubscriberDisconnect SlowSubscriberPolicy = "disconnect"
+)
 
-type RideStatusChannelSlice []RideStatusChannel
+const defaultEventBufferSize = 100
 
 // EventBus stores the information about subscribers interested for // a particular topic
-type EventBus struct {
-	subscribers map[string]RideStatusChannelSlice
-	rm          sync.RWMutex
+// 購読は "chair:{id}" のような完全一致か、"chair:*" のように末尾の * による前方一致で指定する
+type EventBus[T any] struct {
+	name string
+
+	// exact はトピック、prefix は * を除いたパターンごとの購読者
+	exact  map[string]map[*Subscription[T]]struct{}
+	prefix map[string]map[*Subscription[T]]struct{}
+	rm     sync.RWMutex
+
+	bufferSize int
+	policy     SlowSubscriberPolicy
+
+	published    atomic.Int64
+	delivered    atomic.Int64
+	dropped      atomic.Int64
+	disconnected atomic.Int64
+}
+
+// Subscription は EventBus の購読。C からイベントを受け取り、不要になったら Unsubscribe する
+// 遅い購読者として打ち切られた場合は C が閉じられる
+type Subscription[T any] struct {
+	C <-chan Event[T]
+
+	ch      chan Event[T]
+	pattern string
+	bus     *EventBus[T]
+	mu      sync.Mutex
+	closed  bool
+}
+
+type EventBusStats struct {
+	Subscribers  int   `json:"subscribers"`
+	Published    int64 `json:"published"`
+	Delivered    int64 `json:"delivered"`
+	Dropped      int64 `json:"dropped"`
+	Disconnected int64 `json:"disconnected"`
 }
 
-func (eb *EventBus) Subscribe(topic string, ch RideStatusChannel) {
+type registeredEventBus interface {
+	Stats() EventBusStats
+	deliverEncoded(topic string, payload []byte) error
+}
+
+// eventBuses は名前で引ける EventBus の一覧。メトリクスと複数台間での配送に使う
+var (
+	eventBuses     = map[string]registeredEventBus{}
+	eventBusesLock sync.Mutex
+)
+
+func NewEventBus[T any](name string, bufferSize int, policy SlowSubscriberPolicy) *EventBus[T] {
+	if bufferSize <= 0 {
+		bufferSize = defaultEventBufferSize
+	}
+	if policy != SlowSubscriberDrop && policy != SlowSubscriberDisconnect {
+		policy = SlowSubscriberDisconnect
+	}
+	eb := &EventBus[T]{
+		name:       name,
+		exact:      map[string]map[*Subscription[T]]struct{}{},
+		prefix:     map[string]map[*Subscription[T]]struct{}{},
+		bufferSize: bufferSize,
+		policy:     policy,
+	}
+
+	eventBusesLock.Lock()
+	eventBuses[name] = eb
+	eventBusesLock.Unlock()
+
+	return eb
+}
+
+// ISUCON_EVENT_BUFFER (購読者ごとのバッファ数) と ISUCON_EVENT_SLOW_POLICY (drop / disconnect) から EventBus を作る
+func newEventBusFromEnv[T any](name string) *EventBus[T] {
+	bufferSize := defaultEventBufferSize
+	if v := os.Getenv("ISUCON_EVENT_BUFFER"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			slog.Warn("invalid ISUCON_EVENT_BUFFER, using default", slog.String("value", v))
+		} else {
+			bufferSize = n
+		}
+	}
+	return NewEventBus[T](name, bufferSize, SlowSubscriberPolicy(os.Getenv("ISUCON_EVENT_SLOW_POLICY")))
+}
+
+func (eb *EventBus[T]) subscribersFor(pattern string) (map[string]map[*Subscription[T]]struct{}, string) {
+	if p, ok := strings.CutSuffix(pattern, "*"); ok {
+		return eb.prefix, p
+	}
+	return eb.exact, pattern
+}
+
+func (eb *EventBus[T]) Subscribe(pattern string) *Subscription[T] {
+	ch := make(chan Event[T], eb.bufferSize)
+	sub := &Subscription[T]{
+		C:       ch,
+		ch:      ch,
+		pattern: pattern,
+		bus:     eb,
+	}
+
 	eb.rm.Lock()
-	if prev, found := eb.subscribers[topic]; found {
-		eb.subscribers[topic] = append(prev, ch)
-	} else {
-		eb.subscribers[topic] = append([]RideStatusChannel{}, ch)
+	m, key := eb.subscribersFor(pattern)
+	subs, found := m[key]
+	if !found {
+		subs = map[*Subscription[T]]struct{}{}
+		m[key] = subs
 	}
+	subs[sub] = struct{}{}
 	eb.rm.Unlock()
+
+	return sub
 }
 
-func (eb *EventBus) Unsubscribe(topic string) {
+// Unsubscribe は購読をやめてチャネルを閉じる。何度呼んでもよい
+func (s *Subscription[T]) Unsubscribe() {
+	eb := s.bus
 	eb.rm.Lock()
-	delete(eb.subscribers, topic)
+	m, key := eb.subscribersFor(s.pattern)
+	if subs, found := m[key]; found {
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(m, key)
+		}
+	}
 	eb.rm.Unlock()
+
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+	s.mu.Unlock()
+}
+
+// send はブロックせずにイベントを送り、送れたかどうかを返す
+func (s *Subscription[T]) send(event Event[T]) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return true
+	}
+	select {
+	case s.ch <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// Publish は topic に一致する購読者にイベントを送る
+// プロセス内で配送する場合は呼び出し側はブロックしない。eventTransport がある場合はその書き込みを待つ
+func (eb *EventBus[T]) Publish(topic string, data T) {
+	eb.published.Add(1)
+
+	if eventTransport != nil {
+		if err := eventTransport.Send(context.Background(), eb.name, topic, data); err != nil {
+			slog.Error("failed to send event", slog.String("bus", eb.name), slog.String("topic", topic), slog.Any("err", err))
+		}
+		return
+	}
+	eb.deliver(Event[T]{Data: data, Topic: topic})
+}
+
+// deliverEncoded は eventTransport から受け取った JSON のイベントをこのプロセスの購読者に送る
+func (eb *EventBus[T]) deliverEncoded(topic string, payload []byte) error {
+	var data T
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return err
+	}
+	eb.deliver(Event[T]{Data: data, Topic: topic})
+	return nil
 }
 
-func (eb *EventBus) Publish(topic string, data RideStatusEventData) {
+func (eb *EventBus[T]) deliver(event Event[T]) {
 	eb.rm.RLock()
-	if chans, found := eb.subscribers[topic]; found {
-		// this is done because the slices refer to same array even though they are passed by value
-		// thus we are creating a new slice with our elements thus preserve locking correctly.
-		channels := append(RideStatusChannelSlice{}, chans...)
-		go func(data RideStatusEvent, RideStatusChannelSlices RideStatusChannelSlice) {
-			for _, ch := range RideStatusChannelSlices {
-				ch <- data
+	slow := []*Subscription[T]{}
+	deliver := func(subs map[*Subscription[T]]struct{}) {
+		for sub := range subs {
+			if sub.send(event) {
+				eb.delivered.Add(1)
+				continue
+			}
+			eb.dropped.Add(1)
+			if eb.policy == SlowSubscriberDisconnect {
+				slow = append(slow, sub)
 			}
-		}(RideStatusEvent{Data: data, Topic: topic}, channels)
+		}
+	}
+	deliver(eb.exact[event.Topic])
+	for p, subs := range eb.prefix {
+		if strings.HasPrefix(event.Topic, p) {
+			deliver(subs)
+		}
 	}
 	eb.rm.RUnlock()
+
+	for _, sub := range slow {
+		slog.Warn("disconnecting slow event bus subscriber", slog.String("bus", eb.name), slog.String("topic", event.Topic))
+		eb.disconnected.Add(1)
+		sub.Unsubscribe()
+	}
 }
 
-var eb = &EventBus{
-	subscribers: map[string]RideStatusChannelSlice{},
+func (eb *EventBus[T]) Stats() EventBusStats {
+	eb.rm.RLock()
+	subscribers := 0
+	for _, subs := range eb.exact {
+		subscribers += len(subs)
+	}
+	for _, subs := range eb.prefix {
+		subscribers += len(subs)
+	}
+	eb.rm.RUnlock()
+
+	return EventBusStats{
+		Subscribers:  subscribers,
+		Published:    eb.published.Load(),
+		Delivered:    eb.delivered.Load(),
+		Dropped:      eb.dropped.Load(),
+		Disconnected: eb.disconnected.Load(),
+	}
+}
+
+func getEventBusStats() map[string]EventBusStats {
+	eventBusesLock.Lock()
+	defer eventBusesLock.Unlock()
+
+	stats := make(map[string]EventBusStats, len(eventBuses))
+	for name, eb := range eventBuses {
+		stats[name] = eb.Stats()
+	}
+	return stats
 }
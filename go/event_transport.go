@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 複数台のアプリケーションでイベントを共有するための EventBus の配送方式
+// ISUCON_EVENT_BACKEND=mysql の場合、Publish されたイベントは bus_events テーブルに書き込まれ、
+// 各インスタンスが起動時点の MAX(id) から順にポーリングして自分の購読者に配る
+// 未指定(memory)の場合はプロセス内でのみ配送する
+
+const (
+	eventBackendMemory = "memory"
+	eventBackendMySQL  = "mysql"
+
+	defaultEventPollInterval = 100 * time.Millisecond
+	eventPollBatchSize       = 500
+	busEventRetention        = 10 * time.Minute
+	busEventPurgeInterval    = time.Minute
+	busEventGapTimeout       = 5 * time.Second
+)
+
+// eventTransport が nil でなければ EventBus.Publish はプロセス内ではなくこちらに送る
+var eventTransport *mysqlEventTransport
+
+type mysqlEventTransport struct {
+	backgroundLoop
+	pollInterval time.Duration
+}
+
+type busEvent struct {
+	ID      int64           `db:"id"`
+	Bus     string          `db:"bus"`
+	Topic   string          `db:"topic"`
+	Payload json.RawMessage `db:"payload"`
+}
+
+// ISUCON_EVENT_BACKEND と ISUCON_EVENT_POLL_INTERVAL (秒) から配送方式を決める
+// memory の場合は nil を返す
+func newEventTransportFromEnv() *mysqlEventTransport {
+	switch backend := os.Getenv("ISUCON_EVENT_BACKEND"); backend {
+	case "", eventBackendMemory:
+		return nil
+	case eventBackendMySQL:
+	default:
+		slog.Warn("unknown ISUCON_EVENT_BACKEND, using memory", slog.String("value", backend))
+		return nil
+	}
+
+	interval := defaultEventPollInterval
+	if v := os.Getenv("ISUCON_EVENT_POLL_INTERVAL"); v != "" {
+		sec, err := strconv.ParseFloat(v, 64)
+		if err != nil || sec <= 0 {
+			slog.Warn("invalid ISUCON_EVENT_POLL_INTERVAL, using default", slog.String("value", v))
+		} else {
+			interval = time.Duration(sec * float64(time.Second))
+		}
+	}
+	return &mysqlEventTransport{pollInterval: interval}
+}
+
+// Send はイベントを bus_events に書き込む。自分自身の購読者にもポーリング経由で届く
+func (t *mysqlEventTransport) Send(ctx context.Context, bus, topic string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO bus_events (bus, topic, payload) VALUES (?, ?, ?)`, bus, topic, payload)
+	return err
+}
+
+// Start はポーリングのgoroutineを起動する
+// 起動前のイベントは配らないので、初期化でテーブルを作り直した後も起動し直せばよい
+func (t *mysqlEventTransport) Start() {
+	t.backgroundLoop.Start(t.loop)
+}
+
+func (t *mysqlEventTransport) loop(ctx context.Context) {
+	var cursor int64
+	for {
+		if err := db.GetContext(ctx, &cursor, `SELECT IFNULL(MAX(id), 0) FROM bus_events`); err == nil {
+			break
+		} else if ctx.Err() != nil {
+			return
+		} else {
+			slog.Error("failed to get bus event cursor", slog.Any("err", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+
+	gaps := map[int64]time.Time{}
+	ticker := time.NewTicker(t.pollInterval)
+	defer ticker.Stop()
+	purgeTicker := time.NewTicker(busEventPurgeInterval)
+	defer purgeTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-purgeTicker.C:
+			if _, err := db.ExecContext(ctx, `DELETE FROM bus_events WHERE created_at < ?`, time.Now().Add(-busEventRetention)); err != nil && ctx.Err() == nil {
+				slog.Error("failed to purge bus events", slog.Any("err", err))
+			}
+			continue
+		case <-ticker.C:
+		}
+
+		next, err := t.poll(ctx, cursor, gaps)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("failed to poll bus events", slog.Any("err", err))
+		}
+		cursor = next
+	}
+}
+
+// poll は cursor より後のイベントを購読者に配り、次の cursor を返す
+// AUTO_INCREMENT の ID はコミット順とは限らないので、飛ばした ID はしばらく gaps に残して読み直す
+func (t *mysqlEventTransport) poll(ctx context.Context, cursor int64, gaps map[int64]time.Time) (int64, error) {
+	now := time.Now()
+	for id, seen := range gaps {
+		if now.Sub(seen) > busEventGapTimeout {
+			delete(gaps, id)
+		}
+	}
+	if len(gaps) > 0 {
+		ids := make([]int64, 0, len(gaps))
+		for id := range gaps {
+			ids = append(ids, id)
+		}
+		query, args, err := sqlx.In(`SELECT id, bus, topic, payload FROM bus_events WHERE id IN (?) ORDER BY id`, ids)
+		if err != nil {
+			return cursor, err
+		}
+		events := []busEvent{}
+		if err := db.SelectContext(ctx, &events, query, args...); err != nil {
+			return cursor, err
+		}
+		for _, e := range events {
+			delete(gaps, e.ID)
+		}
+		deliverBusEvents(events)
+	}
+
+	for {
+		events := []busEvent{}
+		if err := db.SelectContext(ctx, &events, `SELECT id, bus, topic, payload FROM bus_events WHERE id > ? ORDER BY id LIMIT ?`, cursor, eventPollBatchSize); err != nil {
+			return cursor, err
+		}
+		for _, e := range events {
+			for id := cursor + 1; id < e.ID; id++ {
+				gaps[id] = now
+			}
+			cursor = e.ID
+		}
+		deliverBusEvents(events)
+
+		if len(events) < eventPollBatchSize {
+			return cursor, nil
+		}
+	}
+}
+
+func deliverBusEvents(events []busEvent) {
+	eventBusesLock.Lock()
+	defer eventBusesLock.Unlock()
+
+	for _, e := range events {
+		eb, ok := eventBuses[e.Bus]
+		if !ok {
+			continue
+		}
+		if err := eb.deliverEncoded(e.Topic, e.Payload); err != nil {
+			slog.Error("failed to decode bus event", slog.Int64("id", e.ID), slog.String("bus", e.Bus), slog.Any("err", err))
+		}
+	}
+}
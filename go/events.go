@@ -0,0 +1,83 @@
+package main
+
+import (
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// EventBus のトピックは "{種類}:{ID}" とする
+// 椅子に関するイベントは椅子とそのオーナーの両方のトピックに、利用者に関するイベントは利用者のトピックに流す
+func userTopic(userID string) string   { return "user:" + userID }
+func chairTopic(chairID string) string { return "chair:" + chairID }
+func ownerTopic(ownerID string) string { return "owner:" + ownerID }
+
+type RideStatusEventData struct {
+	Ride   Ride
+	UserID string
+	Status RideState
+	// 通知の対象となった ride_statuses の ID
+	RideStatusID string
+}
+
+type ChairLocationEventData struct {
+	ChairID    string
+	OwnerID    string
+	Coordinate Coordinate
+	RecordedAt time.Time
+}
+
+type ChairActivityEventData struct {
+	// 複数台やアウトボックスから重複して届いた場合に見分けるためのID
+	ID       string
+	ChairID  string
+	OwnerID  string
+	IsActive bool
+}
+
+type PaymentEventData struct {
+	RideID string
+	UserID string
+	Amount int
+	// SUCCEEDED または PAYMENT_FAILED
+	Status string
+	// 決済に失敗した場合のエラー。成功時は空
+	Error string
+}
+
+type CouponGrantEventData struct {
+	UserID       string
+	Code         string
+	Discount     int
+	DiscountType string
+}
+
+var (
+	rideStatusEvents    = newEventBusFromEnv[RideStatusEventData]("ride_status")
+	chairLocationEvents = newEventBusFromEnv[ChairLocationEventData]("chair_location")
+	chairActivityEvents = newEventBusFromEnv[ChairActivityEventData]("chair_activity")
+	paymentEvents       = newEventBusFromEnv[PaymentEventData]("payment")
+	couponGrantEvents   = newEventBusFromEnv[CouponGrantEventData]("coupon_grant")
+)
+
+func publishChairLocation(chair *Chair, coordinate Coordinate, recordedAt time.Time) {
+	data := ChairLocationEventData{
+		ChairID:    chair.ID,
+		OwnerID:    chair.OwnerID,
+		Coordinate: coordinate,
+		RecordedAt: recordedAt,
+	}
+	chairLocationEvents.Publish(chairTopic(chair.ID), data)
+	chairLocationEvents.Publish(ownerTopic(chair.OwnerID), data)
+}
+
+func publishChairActivity(chair *Chair, isActive bool) {
+	data := ChairActivityEventData{
+		ID:       ulid.Make().String(),
+		ChairID:  chair.ID,
+		OwnerID:  chair.OwnerID,
+		IsActive: isActive,
+	}
+	chairActivityEvents.Publish(chairTopic(chair.ID), data)
+	chairActivityEvents.Publish(ownerTopic(chair.OwnerID), data)
+}
@@ -1,53 +1,484 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/oklog/ulid/v2"
 )
 
-// このAPIをインスタンス内から一定間隔で叩かせることで、椅子とライドをマッチングさせる
+// マッチングは matcher が常時実行しているので、このAPIは手動で一度だけ実行させるためのもの
 func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	// MEMO: 一旦最も待たせているリクエストに適当な空いている椅子マッチさせる実装とする。おそらくもっといい方法があるはず…
-	ride := &Ride{}
-	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id IS NULL ORDER BY created_at LIMIT 1`); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNoContent)
+	if _, err := matcher.RunOnce(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type internalGetMetricsResponse struct {
+	EventBuses     map[string]EventBusStats `json:"event_buses"`
+	PaymentGateway paymentGatewayStats      `json:"payment_gateway"`
+}
+
+func internalGetMetrics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &internalGetMetricsResponse{
+		EventBuses:     getEventBusStats(),
+		PaymentGateway: paymentGateway.Stats(),
+	})
+}
+
+// 管理者がライドの決済を返金する。チャージ後に揉めたライドなどに使う
+func internalPostRideRefund(w http.ResponseWriter, r *http.Request) {
+	rideID := r.PathValue("ride_id")
+	exists := false
+	if err := db.GetContext(r.Context(), &exists, `SELECT EXISTS(SELECT 1 FROM rides WHERE id = ?)`, rideID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+
+	writeRefund(w, r, rideID, RefundRequestedByAdmin)
+}
+
+// 社内決済マイクロサービスの決済と、完了したライドやキャンセル料を照合する
+// since (UNIXミリ秒) 以降のライドだけを照合し、retry=true の場合は請求されていないライドの決済を積み直す
+func internalPostReconcilePayments(w http.ResponseWriter, r *http.Request) {
+	opts := reconcileOptions{Since: time.Unix(0, 0)}
+	if r.URL.Query().Get("since") != "" {
+		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
 			return
 		}
+		opts.Since = time.UnixMilli(parsed)
+	}
+	if r.URL.Query().Get("retry") != "" {
+		retry, err := strconv.ParseBool(r.URL.Query().Get("retry"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		opts.RetryMissing = retry
+	}
+
+	report, err := reconcilePayments(r.Context(), opts)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	matched := &Chair{}
-	empty := false
-	for i := 0; i < 10; i++ {
-		if err := db.GetContext(ctx, matched, "SELECT * FROM chairs INNER JOIN (SELECT id FROM chairs WHERE is_active = TRUE ORDER BY RAND() LIMIT 1) AS tmp ON chairs.id = tmp.id LIMIT 1"); err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				w.WriteHeader(http.StatusNoContent)
-				return
-			}
-			writeError(w, http.StatusInternalServerError, err)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// 椅子の割り当てを待っている全ライドと全空き椅子を、設定されたマッチング戦略で一括して割り当てる
+// 割り当てたライドの件数を返す
+func matchWaitingRides(ctx context.Context) (int, error) {
+	rides := []MatchingRide{}
+	if err := db.SelectContext(ctx, &rides, `SELECT id, pickup_latitude, pickup_longitude, created_at FROM rides WHERE chair_id IS NULL AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = rides.id AND status = 'CANCELED') ORDER BY created_at`); err != nil {
+		return 0, err
+	}
+	if len(rides) == 0 {
+		return 0, nil
+	}
+
+	rejections := []RideRejection{}
+	if err := db.SelectContext(ctx, &rejections, `SELECT rr.* FROM ride_rejections rr INNER JOIN rides r ON r.id = rr.ride_id WHERE r.chair_id IS NULL`); err != nil {
+		return 0, err
+	}
+	if len(rejections) > 0 {
+		rejectedChairIDsByRideID := map[string][]string{}
+		for _, rejection := range rejections {
+			rejectedChairIDsByRideID[rejection.RideID] = append(rejectedChairIDsByRideID[rejection.RideID], rejection.ChairID)
+		}
+		for i := range rides {
+			rides[i].RejectedChairIDs = rejectedChairIDsByRideID[rides[i].ID]
 		}
+	}
 
-		if err := db.GetContext(ctx, &empty, "SELECT COUNT(*) = 0 FROM (SELECT COUNT(chair_sent_at) = 6 AS completed FROM ride_statuses WHERE ride_id IN (SELECT id FROM rides WHERE chair_id = ?) GROUP BY ride_id) is_completed WHERE completed = FALSE", matched.ID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+	chairs, err := getFreeChairs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(chairs) == 0 {
+		return 0, nil
+	}
+
+	m, err := getMatcher(ctx)
+	if err != nil {
+		return 0, err
+	}
+	assignments := m.Match(rides, chairs)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	matched := []MatchingAssignment{}
+	for _, a := range assignments {
+		// 読み取った後にキャンセルされたライドには割り当てない
+		result, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ? AND chair_id IS NULL AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = rides.id AND status = 'CANCELED')", a.ChairID, a.RideID)
+		if err != nil {
+			return 0, err
+		}
+		if count, err := result.RowsAffected(); err != nil {
+			return 0, err
+		} else if count == 0 {
+			continue
+		}
+		matched = append(matched, a)
+
+		// 割り当てられた椅子に MATCHING を通知する
+		ride := Ride{}
+		if err := tx.GetContext(ctx, &ride, "SELECT * FROM rides WHERE id = ?", a.RideID); err != nil {
+			return 0, err
+		}
+		statusID := ""
+		if err := tx.GetContext(ctx, &statusID, "SELECT id FROM ride_statuses WHERE ride_id = ? AND status = 'MATCHING' ORDER BY created_at DESC LIMIT 1", a.RideID); err != nil {
+			return 0, err
+		}
+		if err := insertChairRideEvent(ctx, tx, a.ChairID, RideStatusEventData{
+			Ride:         ride,
+			UserID:       ride.UserID,
+			Status:       RideStateMatching,
+			RideStatusID: statusID,
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if len(matched) > 0 {
+		outbox.Trigger()
+	}
+
+	return len(matched), nil
+}
+
+// settings テーブルの matching_strategy に対応するマッチング戦略を返す
+func getMatcher(ctx context.Context) (Matcher, error) {
+	name := ""
+	if err := db.GetContext(ctx, &name, "SELECT value FROM settings WHERE name = 'matching_strategy'"); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		name = defaultMatchingStrategy
+	}
+
+	newMatcher, ok := matchers[name]
+	if !ok {
+		slog.Warn("unknown matching strategy, using default", slog.String("strategy", name))
+		newMatcher = matchers[defaultMatchingStrategy]
+	}
+	return newMatcher(), nil
+}
+
+// 稼働中かつ、割り当て済みのライドがすべて完了(またはキャンセル)通知済みの椅子を位置情報・速度付きで取得する
+// 位置情報が一度も送られていない椅子は迎車時間を見積もれないので対象外とする
+// ロックせずに読むので、割り当てに使う場合は matchingLockName のロックの中で呼ぶこと
+func getFreeChairs(ctx context.Context) ([]MatchingChair, error) {
+	chairs := []MatchingChair{}
+	query := `
+		SELECT c.id, c.model, cm.speed, lcl.latitude, lcl.longitude
+		FROM chairs c
+		         INNER JOIN chair_models cm ON cm.name = c.model
+		         INNER JOIN latest_chair_locations lcl ON lcl.chair_id = c.id
+		WHERE c.is_active = TRUE
+		  AND cm.speed > 0
+		  AND NOT EXISTS (SELECT 1
+		                  FROM rides r
+		                  WHERE r.chair_id = c.id
+		                    AND NOT EXISTS (SELECT 1
+		                                    FROM ride_statuses rs
+		                                    WHERE rs.ride_id = r.id
+		                                      AND rs.status IN ('COMPLETED', 'CANCELED')
+		                                      AND rs.chair_sent_at IS NOT NULL))
+	`
+	if err := db.SelectContext(ctx, &chairs, query); err != nil {
+		return nil, err
+	}
+	return chairs, nil
+}
+
+// 椅子が現在地から配車位置に到着するまでの所要時間を見積もる
+func estimatePickupTime(chair MatchingChair, pickupLatitude, pickupLongitude int) float64 {
+	if chair.Speed <= 0 {
+		return math.Inf(1)
+	}
+	distance := calculateDistance(chair.Latitude, chair.Longitude, pickupLatitude, pickupLongitude)
+	return float64(distance) / float64(chair.Speed)
+}
+
+type internalCouponCampaignResponse struct {
+	ID               string `json:"id"`
+	CodePrefix       string `json:"code_prefix"`
+	GrantOn          string `json:"grant_on"`
+	Discount         int    `json:"discount"`
+	DiscountType     string `json:"discount_type"`
+	MaxDiscount      *int64 `json:"max_discount"`
+	MinFare          *int64 `json:"min_fare"`
+	AppliesTo        string `json:"applies_to"`
+	Eligibility      string `json:"eligibility"`
+	Priority         int    `json:"priority"`
+	StartsAt         *int64 `json:"starts_at"`
+	EndsAt           *int64 `json:"ends_at"`
+	MaxRedemptions   *int64 `json:"max_redemptions"`
+	MaxGrantsPerCode *int64 `json:"max_grants_per_code"`
+	Redemptions      int    `json:"redemptions"`
+	CreatedAt        int64  `json:"created_at"`
+}
+
+func newInternalCouponCampaignResponse(c *CouponCampaign) internalCouponCampaignResponse {
+	res := internalCouponCampaignResponse{
+		ID:           c.ID,
+		CodePrefix:   c.CodePrefix,
+		GrantOn:      c.GrantOn,
+		Discount:     c.Discount,
+		DiscountType: c.DiscountType,
+		AppliesTo:    c.AppliesTo,
+		Eligibility:  c.Eligibility,
+		Priority:     c.Priority,
+		Redemptions:  c.Redemptions,
+		CreatedAt:    c.CreatedAt.UnixMilli(),
+	}
+	if c.MaxDiscount.Valid {
+		res.MaxDiscount = &c.MaxDiscount.Int64
+	}
+	if c.MinFare.Valid {
+		res.MinFare = &c.MinFare.Int64
+	}
+	if c.StartsAt.Valid {
+		t := c.StartsAt.Time.UnixMilli()
+		res.StartsAt = &t
+	}
+	if c.EndsAt.Valid {
+		t := c.EndsAt.Time.UnixMilli()
+		res.EndsAt = &t
+	}
+	if c.MaxRedemptions.Valid {
+		res.MaxRedemptions = &c.MaxRedemptions.Int64
+	}
+	if c.MaxGrantsPerCode.Valid {
+		res.MaxGrantsPerCode = &c.MaxGrantsPerCode.Int64
+	}
+	return res
+}
+
+type internalGetCouponCampaignsResponse struct {
+	Campaigns []internalCouponCampaignResponse `json:"campaigns"`
+}
+
+func internalGetCouponCampaigns(w http.ResponseWriter, r *http.Request) {
+	campaigns := []CouponCampaign{}
+	if err := db.SelectContext(r.Context(), &campaigns, `SELECT * FROM coupon_campaigns ORDER BY created_at`); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := make([]internalCouponCampaignResponse, 0, len(campaigns))
+	for _, c := range campaigns {
+		res = append(res, newInternalCouponCampaignResponse(&c))
+	}
+	writeJSON(w, http.StatusOK, &internalGetCouponCampaignsResponse{Campaigns: res})
+}
+
+// 日時は UNIX ミリ秒。省略した項目は制限しない
+type internalCouponCampaignRequest struct {
+	CodePrefix       string `json:"code_prefix"`
+	GrantOn          string `json:"grant_on"`
+	Discount         int    `json:"discount"`
+	DiscountType     string `json:"discount_type"`
+	MaxDiscount      *int64 `json:"max_discount"`
+	MinFare          *int64 `json:"min_fare"`
+	AppliesTo        string `json:"applies_to"`
+	Eligibility      string `json:"eligibility"`
+	Priority         int    `json:"priority"`
+	StartsAt         *int64 `json:"starts_at"`
+	EndsAt           *int64 `json:"ends_at"`
+	MaxRedemptions   *int64 `json:"max_redemptions"`
+	MaxGrantsPerCode *int64 `json:"max_grants_per_code"`
+}
+
+func (req *internalCouponCampaignRequest) validate() error {
+	if req.Eligibility == "" {
+		req.Eligibility = CouponEligibilityAnyRide
+	}
+	if req.DiscountType == "" {
+		req.DiscountType = CouponDiscountTypeAmount
+	}
+	if req.AppliesTo == "" {
+		req.AppliesTo = CouponAppliesToMetered
+	}
+	if req.Discount <= 0 {
+		return errors.New("discount must be positive")
+	}
+	switch req.DiscountType {
+	case CouponDiscountTypeAmount:
+	case CouponDiscountTypePercent:
+		if req.Discount > 100 {
+			return errors.New("discount must be at most 100 for PERCENT")
 		}
-		if empty {
-			break
+	default:
+		return fmt.Errorf("discount_type must be %s or %s", CouponDiscountTypeAmount, CouponDiscountTypePercent)
+	}
+	if req.AppliesTo != CouponAppliesToMetered && req.AppliesTo != CouponAppliesToTotal {
+		return fmt.Errorf("applies_to must be %s or %s", CouponAppliesToMetered, CouponAppliesToTotal)
+	}
+	if (req.MaxDiscount != nil && *req.MaxDiscount <= 0) || (req.MinFare != nil && *req.MinFare < 0) {
+		return errors.New("max_discount must be positive and min_fare must not be negative")
+	}
+	if req.Eligibility != CouponEligibilityAnyRide && req.Eligibility != CouponEligibilityFirstRideOnly {
+		return fmt.Errorf("eligibility must be %s or %s", CouponEligibilityAnyRide, CouponEligibilityFirstRideOnly)
+	}
+	if req.StartsAt != nil && req.EndsAt != nil && *req.StartsAt >= *req.EndsAt {
+		return errors.New("starts_at must be before ends_at")
+	}
+	if (req.MaxRedemptions != nil && *req.MaxRedemptions < 0) || (req.MaxGrantsPerCode != nil && *req.MaxGrantsPerCode < 0) {
+		return errors.New("max_redemptions and max_grants_per_code must not be negative")
+	}
+	return nil
+}
+
+func millisToNullTime(v *int64) sql.NullTime {
+	if v == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: time.UnixMilli(*v), Valid: true}
+}
+
+// internalPostCouponCampaigns はキャンペーンを作る
+// クーポンはコードのプレフィックスでキャンペーンに対応づけるので、既存のキャンペーンと重なるプレフィックスは使えない
+func internalPostCouponCampaigns(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &internalCouponCampaignRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.CodePrefix == "" {
+		writeError(w, http.StatusBadRequest, errors.New("required fields(code_prefix) are empty"))
+		return
+	}
+	switch req.GrantOn {
+	case CouponGrantOnSignup, CouponGrantOnInvitation, CouponGrantOnInviterReward:
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("grant_on must be one of %s, %s, %s", CouponGrantOnSignup, CouponGrantOnInvitation, CouponGrantOnInviterReward))
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	overlapping := 0
+	if err := tx.GetContext(ctx, &overlapping,
+		`SELECT COUNT(*) FROM coupon_campaigns WHERE LEFT(?, CHAR_LENGTH(code_prefix)) = code_prefix OR LEFT(code_prefix, CHAR_LENGTH(?)) = ? FOR UPDATE`,
+		req.CodePrefix, req.CodePrefix, req.CodePrefix,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if overlapping > 0 {
+		writeError(w, http.StatusConflict, errors.New("code_prefix overlaps with an existing campaign"))
+		return
+	}
+
+	campaignID := ulid.Make().String()
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO coupon_campaigns (id, code_prefix, grant_on, discount, discount_type, max_discount, min_fare, applies_to, eligibility, priority, starts_at, ends_at, max_redemptions, max_grants_per_code) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		campaignID, req.CodePrefix, req.GrantOn, req.Discount, req.DiscountType, req.MaxDiscount, req.MinFare, req.AppliesTo, req.Eligibility, req.Priority, millisToNullTime(req.StartsAt), millisToNullTime(req.EndsAt), req.MaxRedemptions, req.MaxGrantsPerCode,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	campaign := &CouponCampaign{}
+	if err := tx.GetContext(ctx, campaign, `SELECT * FROM coupon_campaigns WHERE id = ?`, campaignID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newInternalCouponCampaignResponse(campaign))
+}
+
+// internalPutCouponCampaign はキャンペーンの内容を置き換える。code_prefix と grant_on は変更できない
+// 割引の内容の変更は、既に付与したクーポンには反映されない。終了させる場合は ends_at を現在時刻にする
+func internalPutCouponCampaign(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	campaignID := r.PathValue("campaign_id")
+	req := &internalCouponCampaignRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	campaign := &CouponCampaign{}
+	if err := tx.GetContext(ctx, campaign, `SELECT * FROM coupon_campaigns WHERE id = ? FOR UPDATE`, campaignID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("campaign not found"))
+			return
 		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
-	if !empty {
-		w.WriteHeader(http.StatusNoContent)
+	if (req.CodePrefix != "" && req.CodePrefix != campaign.CodePrefix) || (req.GrantOn != "" && req.GrantOn != campaign.GrantOn) {
+		writeError(w, http.StatusBadRequest, errors.New("code_prefix and grant_on cannot be changed"))
 		return
 	}
 
-	if _, err := db.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ?", matched.ID, ride.ID); err != nil {
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE coupon_campaigns SET discount = ?, discount_type = ?, max_discount = ?, min_fare = ?, applies_to = ?, eligibility = ?, priority = ?, starts_at = ?, ends_at = ?, max_redemptions = ?, max_grants_per_code = ? WHERE id = ?`,
+		req.Discount, req.DiscountType, req.MaxDiscount, req.MinFare, req.AppliesTo, req.Eligibility, req.Priority, millisToNullTime(req.StartsAt), millisToNullTime(req.EndsAt), req.MaxRedemptions, req.MaxGrantsPerCode, campaignID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.GetContext(ctx, campaign, `SELECT * FROM coupon_campaigns WHERE id = ?`, campaignID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	writeJSON(w, http.StatusOK, newInternalCouponCampaignResponse(campaign))
 }
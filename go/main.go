@@ -7,6 +7,7 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"net"
@@ -57,7 +58,7 @@ func (c *wrappedConn) QueryContext(ctx context.Context, query string, args []dri
 	return nil, driver.ErrSkip
 }
 
-var files []string = []string{"app_handlers.go", "chair_handlers.go", "internal_handlers.go", "owner_handlers.go", "payment_gateway.go"}
+var files []string = []string{"app_handlers.go", "chair_handlers.go", "coupons.go", "internal_handlers.go", "owner_handlers.go", "payment_gateway.go", "payments.go", "pricing.go", "reconcile.go", "refunds.go", "ride_state.go"}
 
 func (c *wrappedConn) addCallerInfo(query string) string {
 	var (
@@ -116,7 +117,7 @@ func chairTotalDistanceProcess() {
 			}
 
 			if _, err := db.NamedExecContext(context.Background(), query, ChairTotalDistances); err != nil {
-				slog.Error("failed to update chair_total_distances", err)
+				slog.Error("failed to update chair_total_distances", slog.Any("err", err))
 			}
 		case <-time.After(2 * time.Minute):
 			return
@@ -129,6 +130,10 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay-matching" {
+		os.Exit(runMatchingReplay(os.Args[2:]))
+	}
+
 	go func() {
 		log.Fatal(http.ListenAndServe(":6060", nil))
 	}()
@@ -139,39 +144,7 @@ func main() {
 }
 
 func setup() http.Handler {
-	host := os.Getenv("ISUCON_DB_HOST")
-	if host == "" {
-		host = "127.0.0.1"
-	}
-	port := os.Getenv("ISUCON_DB_PORT")
-	if port == "" {
-		port = "3306"
-	}
-	_, err := strconv.Atoi(port)
-	if err != nil {
-		panic(fmt.Sprintf("failed to convert DB port number from ISUCON_DB_PORT environment variable into int: %v", err))
-	}
-	user := os.Getenv("ISUCON_DB_USER")
-	if user == "" {
-		user = "isucon"
-	}
-	password := os.Getenv("ISUCON_DB_PASSWORD")
-	if password == "" {
-		password = "isucon"
-	}
-	dbname := os.Getenv("ISUCON_DB_NAME")
-	if dbname == "" {
-		dbname = "isuride"
-	}
-
-	dbConfig := mysql.NewConfig()
-	dbConfig.User = user
-	dbConfig.Passwd = password
-	dbConfig.Addr = net.JoinHostPort(host, port)
-	dbConfig.Net = "tcp"
-	dbConfig.DBName = dbname
-	dbConfig.ParseTime = true
-	dbConfig.InterpolateParams = true
+	dbConfig := newDBConfig()
 
 	// NOTE: 再起動試験対策
 	for {
@@ -185,6 +158,15 @@ func setup() http.Handler {
 		time.Sleep(1 * time.Second)
 	}
 
+	eventTransport = newEventTransportFromEnv()
+	if eventTransport != nil {
+		eventTransport.Start()
+	}
+	matcher.Start(matchingIntervalFromEnv())
+	outbox.Start()
+	webhooks.Start()
+	paymentQueue.Start()
+
 	mux := chi.NewRouter()
 	// mux.Use(middleware.Logger)
 	// mux.Use(middleware.Recoverer)
@@ -196,10 +178,14 @@ func setup() http.Handler {
 
 		authedMux := mux.With(appAuthMiddleware)
 		authedMux.HandleFunc("POST /api/app/payment-methods", appPostPaymentMethods)
+		authedMux.HandleFunc("GET /api/app/payment-methods", appGetPaymentMethods)
+		authedMux.HandleFunc("DELETE /api/app/payment-methods/{payment_method_id}", appDeletePaymentMethod)
+		authedMux.HandleFunc("POST /api/app/payment-methods/{payment_method_id}/default", appPostPaymentMethodDefault)
 		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
 		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
 		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
 		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
+		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/cancel", appPostRideCancel)
 		authedMux.HandleFunc("GET /api/app/notification", appGetNotificationWithSSE)
 		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
 	}
@@ -211,6 +197,12 @@ func setup() http.Handler {
 		authedMux := mux.With(ownerAuthMiddleware)
 		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
 		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+		authedMux.HandleFunc("GET /api/owner/stream", ownerGetStream)
+		authedMux.HandleFunc("POST /api/owner/webhooks", ownerPostWebhook)
+		authedMux.HandleFunc("GET /api/owner/webhooks", ownerGetWebhooks)
+		authedMux.HandleFunc("DELETE /api/owner/webhooks/{webhook_id}", ownerDeleteWebhook)
+		authedMux.HandleFunc("GET /api/owner/webhooks/{webhook_id}/deliveries", ownerGetWebhookDeliveries)
+		authedMux.HandleFunc("POST /api/owner/rides/{ride_id}/refund", ownerPostRideRefund)
 	}
 
 	// chair handlers
@@ -227,11 +219,55 @@ func setup() http.Handler {
 	// internal handlers
 	{
 		mux.HandleFunc("GET /api/internal/matching", internalGetMatching)
+		mux.HandleFunc("GET /api/internal/metrics", internalGetMetrics)
+		mux.HandleFunc("POST /api/internal/rides/{ride_id}/refund", internalPostRideRefund)
+		mux.HandleFunc("POST /api/internal/payments/reconcile", internalPostReconcilePayments)
+		mux.HandleFunc("GET /api/internal/coupon-campaigns", internalGetCouponCampaigns)
+		mux.HandleFunc("POST /api/internal/coupon-campaigns", internalPostCouponCampaigns)
+		mux.HandleFunc("PUT /api/internal/coupon-campaigns/{campaign_id}", internalPutCouponCampaign)
 	}
 
 	return mux
 }
 
+func newDBConfig() *mysql.Config {
+	host := os.Getenv("ISUCON_DB_HOST")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	port := os.Getenv("ISUCON_DB_PORT")
+	if port == "" {
+		port = "3306"
+	}
+	_, err := strconv.Atoi(port)
+	if err != nil {
+		panic(fmt.Sprintf("failed to convert DB port number from ISUCON_DB_PORT environment variable into int: %v", err))
+	}
+	user := os.Getenv("ISUCON_DB_USER")
+	if user == "" {
+		user = "isucon"
+	}
+	password := os.Getenv("ISUCON_DB_PASSWORD")
+	if password == "" {
+		password = "isucon"
+	}
+	dbname := os.Getenv("ISUCON_DB_NAME")
+	if dbname == "" {
+		dbname = "isuride"
+	}
+
+	dbConfig := mysql.NewConfig()
+	dbConfig.User = user
+	dbConfig.Passwd = password
+	dbConfig.Addr = net.JoinHostPort(host, port)
+	dbConfig.Net = "tcp"
+	dbConfig.DBName = dbname
+	dbConfig.ParseTime = true
+	dbConfig.InterpolateParams = true
+
+	return dbConfig
+}
+
 type postInitializeRequest struct {
 	PaymentServer string `json:"payment_server"`
 }
@@ -248,6 +284,20 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 初期化中のテーブルに対してマッチングやイベントの配送が走らないよう止めておく
+	matcher.Stop()
+	defer matcher.Start(matchingIntervalFromEnv())
+	outbox.Stop()
+	defer outbox.Start()
+	webhooks.Stop()
+	defer webhooks.Start()
+	paymentQueue.Stop()
+	defer paymentQueue.Start()
+	if eventTransport != nil {
+		eventTransport.Stop()
+		defer eventTransport.Start()
+	}
+
 	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to initialize: %s: %w", string(out), err))
 		return
@@ -316,6 +366,32 @@ func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
 	w.Write(buf)
 }
 
+// writeSSEEvent は Server-Sent Events の1イベントとして v を書き込む。id が空なら id フィールドは付けない
+func writeSSEEvent(w io.Writer, id string, v interface{}) error {
+	return writeNamedSSEEvent(w, "", id, v)
+}
+
+// writeNamedSSEEvent は event フィールドを付けてイベントを書き込む
+// onmessage で受け取っているクライアントには届かないので、既存の通知と形の違うイベントを送るのに使う
+func writeNamedSSEEvent(w io.Writer, event string, id string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if event != "" {
+		if _, err := fmt.Fprintf(w, "event: %s\n", event); err != nil {
+			return err
+		}
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", buf)
+	return err
+}
+
 func writeError(w http.ResponseWriter, statusCode int, err error) {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	w.WriteHeader(statusCode)
@@ -327,7 +403,7 @@ func writeError(w http.ResponseWriter, statusCode int, err error) {
 	}
 	w.Write(buf)
 
-	slog.Error("error response wrote", err)
+	slog.Error("error response wrote", slog.Any("err", err))
 }
 
 func secureRandomStr(b int) string {
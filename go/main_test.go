@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// setupTestDB は ISUCON_DB_* で指定された MySQL に接続し、テストの間だけ db を差し替える
+// スキーマを読み込んだ使い捨てのDBを用意し、ISUCON_TEST_DB=1 を指定した場合だけ実行する
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	if os.Getenv("ISUCON_TEST_DB") == "" {
+		t.Skip("set ISUCON_TEST_DB=1 to run tests against MySQL")
+	}
+	testDB, err := sqlx.Connect("wrapped-mysql", newDBConfig().FormatDSN())
+	if err != nil {
+		t.Fatalf("failed to connect to MySQL: %v", err)
+	}
+
+	orig := db
+	db = testDB
+	t.Cleanup(func() {
+		db = orig
+		testDB.Close()
+	})
+}
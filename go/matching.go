@@ -0,0 +1,242 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+const defaultMatchingStrategy = "optimal"
+
+// Matcher は割り当て待ちのライドと空き椅子から、ライドと椅子の割り当てを決める
+// rides は依頼日時の古い順に渡される。ライドを辞退した椅子をそのライドに割り当ててはならない
+type Matcher interface {
+	Match(rides []MatchingRide, chairs []MatchingChair) []MatchingAssignment
+}
+
+// 辞退された組み合わせのコスト。最小コスト割り当てで選ばれても結果からは取り除く
+const rejectedCost = 1e12
+
+func (r MatchingRide) rejectedBy(chairID string) bool {
+	return slices.Contains(r.RejectedChairIDs, chairID)
+}
+
+// settings テーブルの matching_strategy に指定できる戦略
+var matchers = map[string]func() Matcher{
+	"random":         func() Matcher { return &randomMatcher{rand: rand.New(rand.NewSource(time.Now().UnixNano()))} },
+	"nearest":        func() Matcher { return nearestMatcher{} },
+	"speed_weighted": func() Matcher { return speedWeightedMatcher{} },
+	"optimal":        func() Matcher { return optimalMatcher{} },
+}
+
+func matcherNames() []string {
+	names := make([]string, 0, len(matchers))
+	for name := range matchers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// randomMatcher は古いライドから順に、空き椅子を無作為に割り当てる
+type randomMatcher struct {
+	rand *rand.Rand
+}
+
+func (m *randomMatcher) Match(rides []MatchingRide, chairs []MatchingChair) []MatchingAssignment {
+	shuffled := slices.Clone(chairs)
+	m.rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	used := make([]bool, len(shuffled))
+	assignments := []MatchingAssignment{}
+	for _, ride := range rides {
+		for j, chair := range shuffled {
+			if used[j] || ride.rejectedBy(chair.ID) {
+				continue
+			}
+			used[j] = true
+			assignments = append(assignments, MatchingAssignment{RideID: ride.ID, ChairID: chair.ID})
+			break
+		}
+	}
+	return assignments
+}
+
+// nearestMatcher は古いライドから順に、配車位置に最も近い空き椅子を割り当てる
+type nearestMatcher struct{}
+
+func (nearestMatcher) Match(rides []MatchingRide, chairs []MatchingChair) []MatchingAssignment {
+	return greedyMatch(rides, chairs, func(ride MatchingRide, chair MatchingChair) float64 {
+		return float64(calculateDistance(chair.Latitude, chair.Longitude, ride.PickupLatitude, ride.PickupLongitude))
+	})
+}
+
+// speedWeightedMatcher は古いライドから順に、迎車時間が最も短い空き椅子を割り当てる
+type speedWeightedMatcher struct{}
+
+func (speedWeightedMatcher) Match(rides []MatchingRide, chairs []MatchingChair) []MatchingAssignment {
+	return greedyMatch(rides, chairs, func(ride MatchingRide, chair MatchingChair) float64 {
+		return estimatePickupTime(chair, ride.PickupLatitude, ride.PickupLongitude)
+	})
+}
+
+// optimalMatcher は全体の迎車時間の合計が最小になるように一括で割り当てる
+type optimalMatcher struct{}
+
+func (optimalMatcher) Match(rides []MatchingRide, chairs []MatchingChair) []MatchingAssignment {
+	if len(rides) == 0 || len(chairs) == 0 {
+		return []MatchingAssignment{}
+	}
+
+	cost := make([][]float64, len(rides))
+	for i, ride := range rides {
+		cost[i] = make([]float64, len(chairs))
+		for j, chair := range chairs {
+			if ride.rejectedBy(chair.ID) {
+				cost[i][j] = rejectedCost
+				continue
+			}
+			cost[i][j] = estimatePickupTime(chair, ride.PickupLatitude, ride.PickupLongitude)
+		}
+	}
+
+	assignments := []MatchingAssignment{}
+	for i, j := range solveAssignment(cost) {
+		if j < 0 || cost[i][j] >= rejectedCost {
+			continue
+		}
+		assignments = append(assignments, MatchingAssignment{RideID: rides[i].ID, ChairID: chairs[j].ID})
+	}
+	return assignments
+}
+
+func greedyMatch(rides []MatchingRide, chairs []MatchingChair, cost func(MatchingRide, MatchingChair) float64) []MatchingAssignment {
+	used := make([]bool, len(chairs))
+	assignments := []MatchingAssignment{}
+	for _, ride := range rides {
+		best := -1
+		bestCost := math.Inf(1)
+		for j, chair := range chairs {
+			if used[j] || ride.rejectedBy(chair.ID) {
+				continue
+			}
+			if c := cost(ride, chair); c < bestCost {
+				bestCost = c
+				best = j
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		used[best] = true
+		assignments = append(assignments, MatchingAssignment{RideID: ride.ID, ChairID: chairs[best].ID})
+	}
+	return assignments
+}
+
+// solveAssignment はコスト行列 cost (行: ライド, 列: 椅子) に対する最小コストの割り当てを
+// ハンガリアン法で求め、行ごとに割り当てた列のインデックスを返す。割り当てがない行は -1 となる。
+func solveAssignment(cost [][]float64) []int {
+	n := len(cost)
+	if n == 0 {
+		return []int{}
+	}
+	m := len(cost[0])
+	if m == 0 {
+		assignment := make([]int, n)
+		for i := range assignment {
+			assignment[i] = -1
+		}
+		return assignment
+	}
+
+	// ハンガリアン法は 行数 <= 列数 を前提とするので、行の方が多ければ転置して解く
+	if n > m {
+		transposed := make([][]float64, m)
+		for j := range transposed {
+			transposed[j] = make([]float64, n)
+			for i := 0; i < n; i++ {
+				transposed[j][i] = cost[i][j]
+			}
+		}
+		colAssignment := solveAssignment(transposed)
+		assignment := make([]int, n)
+		for i := range assignment {
+			assignment[i] = -1
+		}
+		for j, i := range colAssignment {
+			if i >= 0 {
+				assignment[i] = j
+			}
+		}
+		return assignment
+	}
+
+	// u, v はポテンシャル、p[j] は列 j に割り当てられた行 (1-indexed, 0 は未割り当て)
+	u := make([]float64, n+1)
+	v := make([]float64, m+1)
+	p := make([]int, m+1)
+	way := make([]int, m+1)
+	minv := make([]float64, m+1)
+	used := make([]bool, m+1)
+
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		for j := range minv {
+			minv[j] = math.Inf(1)
+			used[j] = false
+		}
+		for {
+			used[j0] = true
+			i0 := p[j0]
+			delta := math.Inf(1)
+			j1 := 0
+			for j := 1; j <= m; j++ {
+				if used[j] {
+					continue
+				}
+				cur := cost[i0-1][j-1] - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= m; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	assignment := make([]int, n)
+	for i := range assignment {
+		assignment[i] = -1
+	}
+	for j := 1; j <= m; j++ {
+		if p[j] != 0 {
+			assignment[p[j]-1] = j - 1
+		}
+	}
+	return assignment
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// マッチング戦略をベンチマーカーを使わずに比較するためのオフライン評価
+//
+//	isuride replay-matching -snapshot snapshot.json
+//	isuride replay-matching -dump snapshot.json   # 現在のDBからスナップショットを書き出す
+//
+// スナップショットを指定しなかった場合は ISUCON_DB_* で接続したDB(初期データを流し込んだもの)から読み込む
+
+type matchingSnapshot struct {
+	Chairs []matchingSnapshotChair `json:"chairs"`
+	Rides  []matchingSnapshotRide  `json:"rides"`
+}
+
+type matchingSnapshotChair struct {
+	ID        string `json:"id" db:"id"`
+	Model     string `json:"model" db:"model"`
+	Speed     int    `json:"speed" db:"speed"`
+	Latitude  int    `json:"latitude" db:"latitude"`
+	Longitude int    `json:"longitude" db:"longitude"`
+}
+
+type matchingSnapshotRide struct {
+	ID                   string    `json:"id" db:"id"`
+	PickupLatitude       int       `json:"pickup_latitude" db:"pickup_latitude"`
+	PickupLongitude      int       `json:"pickup_longitude" db:"pickup_longitude"`
+	DestinationLatitude  int       `json:"destination_latitude" db:"destination_latitude"`
+	DestinationLongitude int       `json:"destination_longitude" db:"destination_longitude"`
+	RequestedAt          time.Time `json:"requested_at" db:"created_at"`
+}
+
+type matchingReplayResult struct {
+	Strategy          string
+	Rides             int
+	Matched           int
+	AvgPickupDistance float64
+	AvgWait           time.Duration
+	ChairUtilization  float64
+	SimulatedDuration time.Duration
+	// Truncated は max-ticks に達して割り当てられずに残ったライドがあることを表す
+	Truncated bool
+}
+
+func runMatchingReplay(args []string) int {
+	fs := flag.NewFlagSet("replay-matching", flag.ContinueOnError)
+	snapshotPath := fs.String("snapshot", "", "JSON snapshot to replay (default: read from the database)")
+	dumpPath := fs.String("dump", "", "write the database snapshot to this file and exit")
+	tick := fs.Duration("tick", time.Second, "simulated time per tick; a chair moves its speed per tick")
+	maxTicks := fs.Int("max-ticks", 1_000_000, "give up after this many ticks")
+	seed := fs.Int64("seed", 1, "seed for the random strategy")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *tick <= 0 {
+		fmt.Fprintln(os.Stderr, "tick must be positive")
+		return 2
+	}
+
+	var snapshot *matchingSnapshot
+	var err error
+	if *snapshotPath != "" {
+		snapshot, err = loadMatchingSnapshotFile(*snapshotPath)
+	} else {
+		snapshot, err = loadMatchingSnapshotFromDB()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *dumpPath != "" {
+		buf, err := json.MarshalIndent(snapshot, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := os.WriteFile(*dumpPath, buf, 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	truncated := []string{}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "strategy\trides\tmatched\tavg pickup distance\tavg wait\tchair utilization\tsimulated\t")
+	for _, name := range matcherNames() {
+		m := matchers[name]()
+		if rm, ok := m.(*randomMatcher); ok {
+			rm.rand = rand.New(rand.NewSource(*seed))
+		}
+		res := replayMatching(name, m, snapshot, *tick, *maxTicks)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.2f\t%s\t%.1f%%\t%s\t\n",
+			res.Strategy, res.Rides, res.Matched, res.AvgPickupDistance, res.AvgWait.Round(time.Millisecond), res.ChairUtilization*100, res.SimulatedDuration)
+		if res.Truncated {
+			truncated = append(truncated, res.Strategy)
+		}
+	}
+	w.Flush()
+
+	// 途中で打ち切った結果は他の戦略と比較できないので失敗扱いにする
+	if len(truncated) > 0 {
+		fmt.Fprintf(os.Stderr, "warning: replay reached -max-ticks=%d before all rides were matched: %s\n", *maxTicks, strings.Join(truncated, ", "))
+		return 1
+	}
+	return 0
+}
+
+func loadMatchingSnapshotFile(path string) (*matchingSnapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	snapshot := &matchingSnapshot{}
+	if err := json.NewDecoder(f).Decode(snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %s: %w", path, err)
+	}
+	return snapshot, nil
+}
+
+func loadMatchingSnapshotFromDB() (*matchingSnapshot, error) {
+	conn, err := sqlx.Connect("mysql", newDBConfig().FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	snapshot := &matchingSnapshot{}
+	// 椅子の初期位置は最初に記録された位置とする
+	if err := conn.Select(&snapshot.Chairs, `
+		SELECT c.id, c.model, cm.speed, cl.latitude, cl.longitude
+		FROM chairs c
+		         INNER JOIN chair_models cm ON cm.name = c.model
+		         INNER JOIN (SELECT chair_id, latitude, longitude,
+		                            ROW_NUMBER() OVER (PARTITION BY chair_id ORDER BY created_at) AS rn
+		                     FROM chair_locations) cl ON cl.chair_id = c.id AND cl.rn = 1
+		WHERE cm.speed > 0
+		ORDER BY c.id`); err != nil {
+		return nil, err
+	}
+	if err := conn.Select(&snapshot.Rides, `
+		SELECT id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, created_at
+		FROM rides
+		ORDER BY created_at`); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+type replayChair struct {
+	MatchingChair
+	busyUntil int
+}
+
+// replayMatching はスナップショットのライドを依頼日時の順に発生させ、tick ごとに m でマッチングを行う
+// 椅子は1tickあたり速度分だけ移動し、迎車と送迎が終わるまで次のライドを受けられない
+func replayMatching(name string, m Matcher, snapshot *matchingSnapshot, tick time.Duration, maxTicks int) matchingReplayResult {
+	res := matchingReplayResult{Strategy: name, Rides: len(snapshot.Rides)}
+	if len(snapshot.Rides) == 0 {
+		return res
+	}
+
+	rides := slices.Clone(snapshot.Rides)
+	slices.SortStableFunc(rides, func(a, b matchingSnapshotRide) int {
+		return a.RequestedAt.Compare(b.RequestedAt)
+	})
+	origin := rides[0].RequestedAt
+	requestedTick := make(map[string]int, len(rides))
+	rideByID := make(map[string]matchingSnapshotRide, len(rides))
+	for _, ride := range rides {
+		requestedTick[ride.ID] = int(ride.RequestedAt.Sub(origin) / tick)
+		rideByID[ride.ID] = ride
+	}
+
+	chairs := make([]*replayChair, 0, len(snapshot.Chairs))
+	chairByID := map[string]*replayChair{}
+	for _, c := range snapshot.Chairs {
+		if c.Speed <= 0 {
+			continue
+		}
+		chair := &replayChair{MatchingChair: MatchingChair{
+			ID: c.ID, Model: c.Model, Speed: c.Speed, Latitude: c.Latitude, Longitude: c.Longitude,
+		}}
+		chairs = append(chairs, chair)
+		chairByID[chair.ID] = chair
+	}
+	if len(chairs) == 0 {
+		return res
+	}
+
+	waiting := []MatchingRide{}
+	next := 0
+	totalPickupDistance := 0
+	totalWaitTicks := 0
+	busyTicks := 0
+	lastTick := 0
+
+	for t := 0; t < maxTicks; t++ {
+		for next < len(rides) && requestedTick[rides[next].ID] <= t {
+			ride := rides[next]
+			waiting = append(waiting, MatchingRide{
+				ID:              ride.ID,
+				PickupLatitude:  ride.PickupLatitude,
+				PickupLongitude: ride.PickupLongitude,
+				CreatedAt:       ride.RequestedAt,
+			})
+			next++
+		}
+		if len(waiting) == 0 {
+			if next == len(rides) {
+				break
+			}
+			continue
+		}
+
+		free := []MatchingChair{}
+		for _, chair := range chairs {
+			if chair.busyUntil <= t {
+				free = append(free, chair.MatchingChair)
+			}
+		}
+		if len(free) == 0 {
+			continue
+		}
+
+		matched := map[string]bool{}
+		for _, a := range m.Match(waiting, free) {
+			chair, ok := chairByID[a.ChairID]
+			ride, rideOK := rideByID[a.RideID]
+			if !ok || !rideOK || chair.busyUntil > t || matched[a.RideID] {
+				continue
+			}
+			matched[a.RideID] = true
+
+			pickupDistance := calculateDistance(chair.Latitude, chair.Longitude, ride.PickupLatitude, ride.PickupLongitude)
+			rideDistance := calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+			pickupTicks := ceilDiv(pickupDistance, chair.Speed)
+			rideTicks := ceilDiv(rideDistance, chair.Speed)
+
+			totalPickupDistance += pickupDistance
+			totalWaitTicks += t - requestedTick[ride.ID] + pickupTicks
+			busyTicks += pickupTicks + rideTicks
+
+			chair.busyUntil = t + pickupTicks + rideTicks
+			chair.Latitude = ride.DestinationLatitude
+			chair.Longitude = ride.DestinationLongitude
+			lastTick = max(lastTick, chair.busyUntil)
+			res.Matched++
+		}
+		waiting = slices.DeleteFunc(waiting, func(r MatchingRide) bool {
+			return matched[r.ID]
+		})
+	}
+	res.Truncated = len(waiting) > 0 || next < len(rides)
+
+	if res.Matched > 0 {
+		res.AvgPickupDistance = float64(totalPickupDistance) / float64(res.Matched)
+		res.AvgWait = time.Duration(float64(totalWaitTicks) / float64(res.Matched) * float64(tick))
+	}
+	if lastTick > 0 {
+		res.ChairUtilization = float64(busyTicks) / float64(lastTick*len(chairs))
+	}
+	res.SimulatedDuration = time.Duration(lastTick) * tick
+
+	return res
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMatchingInterval = 500 * time.Millisecond
+
+	// 複数台で動かしている場合に同じ空き椅子を別々のライドに割り当てないよう、マッチングは全台を通して
+	// MySQL の名前付きロックで直列に行う。空き椅子の読み取りから割り当てまでをこのロックの中で行うこと
+	matchingLockName    = "isuride_matching"
+	matchingLockTimeout = 5 // 秒
+)
+
+// matchingScheduler は一定間隔、またはライドの作成・椅子の解放をきっかけにマッチングを実行する
+type matchingScheduler struct {
+	triggeredLoop
+}
+
+var matcher = &matchingScheduler{}
+
+// ISUCON_MATCHING_INTERVAL (秒) からマッチング間隔を読み取る
+func matchingIntervalFromEnv() time.Duration {
+	v := os.Getenv("ISUCON_MATCHING_INTERVAL")
+	if v == "" {
+		return defaultMatchingInterval
+	}
+	sec, err := strconv.ParseFloat(v, 64)
+	if err != nil || sec <= 0 {
+		slog.Warn("invalid ISUCON_MATCHING_INTERVAL, using default", slog.String("value", v))
+		return defaultMatchingInterval
+	}
+	return time.Duration(sec * float64(time.Second))
+}
+
+// Start はマッチングのgoroutineを起動する。既に起動している場合は停止を待ってから起動し直す
+func (s *matchingScheduler) Start(interval time.Duration) {
+	s.triggeredLoop.Start(interval, func(ctx context.Context) {
+		if _, err := s.RunOnce(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("failed to match rides", slog.Any("err", err))
+		}
+	})
+}
+
+// RunOnce はマッチングを一度だけ実行し、割り当てたライドの件数を返す
+// 他のインスタンスがマッチング中でロックを取れなかった場合は何もしない
+func (s *matchingScheduler) RunOnce(ctx context.Context) (int, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	// 名前付きロックはセッションに紐づくので、取得と解放は同じ接続で行う
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	locked := sql.NullInt64{}
+	if err := conn.GetContext(ctx, &locked, "SELECT GET_LOCK(?, ?)", matchingLockName, matchingLockTimeout); err != nil {
+		return 0, err
+	}
+	if locked.Int64 != 1 {
+		slog.Warn("matching lock is held by another instance")
+		return 0, nil
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.WithoutCancel(ctx), "SELECT RELEASE_LOCK(?)", matchingLockName); err != nil {
+			// ロックを持ったまま接続がプールに戻らないよう、接続ごと捨てる
+			slog.Error("failed to release matching lock", slog.Any("err", err))
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+
+	return matchWaitingRides(ctx)
+}
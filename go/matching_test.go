@@ -0,0 +1,219 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// bruteForceAssignment は min(行数, 列数) 組を割り当てる全ての割り当てを試し、最小のコストを返す
+func bruteForceAssignment(cost [][]float64) float64 {
+	n := len(cost)
+	if n == 0 {
+		return 0
+	}
+	m := len(cost[0])
+	want := min(n, m)
+
+	best := math.Inf(1)
+	used := make([]bool, m)
+	var search func(i, assigned int, sum float64)
+	search = func(i, assigned int, sum float64) {
+		if assigned+(n-i) < want {
+			return
+		}
+		if i == n {
+			best = min(best, sum)
+			return
+		}
+		// 列が足りない場合は割り当てない行がある
+		search(i+1, assigned, sum)
+		for j := 0; j < m; j++ {
+			if used[j] {
+				continue
+			}
+			used[j] = true
+			search(i+1, assigned+1, sum+cost[i][j])
+			used[j] = false
+		}
+	}
+	search(0, 0, 0)
+	return best
+}
+
+// checkAssignment は割り当てが列を重複して使わず、min(行数, 列数) 組を割り当てていることを確かめ、コストの合計を返す
+func checkAssignment(t *testing.T, cost [][]float64, assignment []int) float64 {
+	t.Helper()
+
+	if len(assignment) != len(cost) {
+		t.Fatalf("len(assignment) = %d, want %d", len(assignment), len(cost))
+	}
+	m := 0
+	if len(cost) > 0 {
+		m = len(cost[0])
+	}
+
+	sum := 0.0
+	assigned := 0
+	usedBy := map[int]int{}
+	for i, j := range assignment {
+		if j < 0 {
+			continue
+		}
+		if j >= m {
+			t.Fatalf("row %d is assigned to column %d, which is out of range", i, j)
+		}
+		if other, ok := usedBy[j]; ok {
+			t.Fatalf("column %d is assigned to both row %d and row %d", j, other, i)
+		}
+		usedBy[j] = i
+		sum += cost[i][j]
+		assigned++
+	}
+	if want := min(len(cost), m); assigned != want {
+		t.Fatalf("assigned %d rows, want %d", assigned, want)
+	}
+	return sum
+}
+
+func TestSolveAssignment(t *testing.T) {
+	tests := []struct {
+		name string
+		cost [][]float64
+	}{
+		{
+			name: "empty",
+			cost: [][]float64{},
+		},
+		{
+			name: "no columns",
+			cost: [][]float64{{}, {}},
+		},
+		{
+			name: "single",
+			cost: [][]float64{{3}},
+		},
+		{
+			name: "greedy is not optimal",
+			cost: [][]float64{
+				{1, 2},
+				{2, 100},
+			},
+		},
+		{
+			name: "square",
+			cost: [][]float64{
+				{4, 1, 3},
+				{2, 0, 5},
+				{3, 2, 2},
+			},
+		},
+		{
+			name: "more chairs than rides",
+			cost: [][]float64{
+				{7, 3, 9, 1},
+				{2, 8, 1, 6},
+			},
+		},
+		{
+			name: "more rides than chairs",
+			cost: [][]float64{
+				{7, 2},
+				{3, 8},
+				{9, 1},
+				{1, 6},
+			},
+		},
+		{
+			name: "rejected pairs are avoided when possible",
+			cost: [][]float64{
+				{rejectedCost, 5},
+				{1, rejectedCost},
+			},
+		},
+		{
+			name: "ties",
+			cost: [][]float64{
+				{1, 1, 1},
+				{1, 1, 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkAssignment(t, tt.cost, solveAssignment(tt.cost))
+			if want := bruteForceAssignment(tt.cost); got != want {
+				t.Errorf("total cost = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSolveAssignmentRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for range 500 {
+		n := r.Intn(6) + 1
+		m := r.Intn(6) + 1
+		cost := make([][]float64, n)
+		for i := range cost {
+			cost[i] = make([]float64, m)
+			for j := range cost[i] {
+				if r.Intn(8) == 0 {
+					cost[i][j] = rejectedCost
+					continue
+				}
+				cost[i][j] = float64(r.Intn(100))
+			}
+		}
+
+		got := checkAssignment(t, cost, solveAssignment(cost))
+		if want := bruteForceAssignment(cost); got != want {
+			t.Fatalf("cost %v: total cost = %v, want %v", cost, got, want)
+		}
+	}
+}
+
+func TestOptimalMatcherSkipsRejectedChairs(t *testing.T) {
+	rides := []MatchingRide{
+		{ID: "ride1", PickupLatitude: 0, PickupLongitude: 0, RejectedChairIDs: []string{"chair1"}},
+		{ID: "ride2", PickupLatitude: 100, PickupLongitude: 100, RejectedChairIDs: []string{"chair1"}},
+	}
+	chairs := []MatchingChair{
+		{ID: "chair1", Speed: 10, Latitude: 0, Longitude: 0},
+	}
+
+	// 唯一の椅子はどちらのライドにも辞退しているので、割り当てない
+	if got := (optimalMatcher{}).Match(rides, chairs); len(got) != 0 {
+		t.Errorf("Match() = %v, want no assignments", got)
+	}
+
+	chairs = append(chairs, MatchingChair{ID: "chair2", Speed: 10, Latitude: 90, Longitude: 90})
+	got := (optimalMatcher{}).Match(rides, chairs)
+	if len(got) != 1 || got[0].ChairID != "chair2" {
+		t.Errorf("Match() = %v, want chair2 only", got)
+	}
+}
+
+func TestReplayMatchingTruncated(t *testing.T) {
+	origin := time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)
+	snapshot := &matchingSnapshot{
+		Chairs: []matchingSnapshotChair{{ID: "c1", Model: "m", Speed: 1}},
+		Rides: []matchingSnapshotRide{
+			{ID: "r1", DestinationLatitude: 10, RequestedAt: origin},
+			{ID: "r2", DestinationLatitude: 10, RequestedAt: origin},
+		},
+	}
+
+	// 椅子が1台なので、2件目は1件目の送迎が終わる10tick目まで割り当てられない
+	res := replayMatching("nearest", nearestMatcher{}, snapshot, time.Second, 5)
+	if !res.Truncated || res.Matched != 1 {
+		t.Errorf("max-ticks=5: truncated=%v matched=%d, want truncated with 1 match", res.Truncated, res.Matched)
+	}
+
+	res = replayMatching("nearest", nearestMatcher{}, snapshot, time.Second, 100)
+	if res.Truncated || res.Matched != 2 {
+		t.Errorf("max-ticks=100: truncated=%v matched=%d, want 2 matches", res.Truncated, res.Matched)
+	}
+}
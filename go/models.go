@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"time"
 )
 
@@ -70,8 +71,10 @@ type User struct {
 }
 
 type PaymentToken struct {
+	ID        string    `db:"id"`
 	UserID    string    `db:"user_id"`
 	Token     string    `db:"token"`
+	IsDefault bool      `db:"is_default"`
 	CreatedAt time.Time `db:"created_at"`
 }
 
@@ -97,6 +100,13 @@ type RideStatus struct {
 	ChairSentAt *time.Time `db:"chair_sent_at"`
 }
 
+type RideCancellation struct {
+	RideID    string    `db:"ride_id"`
+	Status    string    `db:"status"`
+	Fee       int       `db:"fee"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
 type Owner struct {
 	ID                 string    `db:"id"`
 	Name               string    `db:"name"`
@@ -107,9 +117,113 @@ type Owner struct {
 }
 
 type Coupon struct {
-	UserID    string    `db:"user_id"`
-	Code      string    `db:"code"`
-	Discount  int       `db:"discount"`
+	UserID       string        `db:"user_id"`
+	Code         string        `db:"code"`
+	Discount     int           `db:"discount"`
+	DiscountType string        `db:"discount_type"`
+	MaxDiscount  sql.NullInt64 `db:"max_discount"`
+	MinFare      sql.NullInt64 `db:"min_fare"`
+	AppliesTo    string        `db:"applies_to"`
+	CreatedAt    time.Time     `db:"created_at"`
+	UsedBy       *string       `db:"used_by"`
+}
+
+type CouponCampaign struct {
+	ID               string        `db:"id"`
+	CodePrefix       string        `db:"code_prefix"`
+	GrantOn          string        `db:"grant_on"`
+	Discount         int           `db:"discount"`
+	DiscountType     string        `db:"discount_type"`
+	MaxDiscount      sql.NullInt64 `db:"max_discount"`
+	MinFare          sql.NullInt64 `db:"min_fare"`
+	AppliesTo        string        `db:"applies_to"`
+	Eligibility      string        `db:"eligibility"`
+	Priority         int           `db:"priority"`
+	StartsAt         sql.NullTime  `db:"starts_at"`
+	EndsAt           sql.NullTime  `db:"ends_at"`
+	MaxRedemptions   sql.NullInt64 `db:"max_redemptions"`
+	MaxGrantsPerCode sql.NullInt64 `db:"max_grants_per_code"`
+	Redemptions      int           `db:"redemptions"`
+	CreatedAt        time.Time     `db:"created_at"`
+	UpdatedAt        time.Time     `db:"updated_at"`
+}
+
+type MatchingChair struct {
+	ID        string `db:"id"`
+	Model     string `db:"model"`
+	Speed     int    `db:"speed"`
+	Latitude  int    `db:"latitude"`
+	Longitude int    `db:"longitude"`
+}
+
+type MatchingRide struct {
+	ID              string    `db:"id"`
+	PickupLatitude  int       `db:"pickup_latitude"`
+	PickupLongitude int       `db:"pickup_longitude"`
+	CreatedAt       time.Time `db:"created_at"`
+
+	// このライドへの割り当てを辞退した椅子
+	RejectedChairIDs []string `db:"-"`
+}
+
+type RideRejection struct {
+	RideID    string    `db:"ride_id"`
+	ChairID   string    `db:"chair_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type MatchingAssignment struct {
+	RideID  string
+	ChairID string
+}
+
+type OwnerWebhook struct {
+	ID        string    `db:"id"`
+	OwnerID   string    `db:"owner_id"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	Events    string    `db:"events"`
 	CreatedAt time.Time `db:"created_at"`
-	UsedBy    *string   `db:"used_by"`
+}
+
+type OwnerWebhookDelivery struct {
+	ID             int64           `db:"id"`
+	WebhookID      string          `db:"webhook_id"`
+	EventID        string          `db:"event_id"`
+	EventType      string          `db:"event_type"`
+	Payload        json.RawMessage `db:"payload"`
+	Status         string          `db:"status"`
+	Attempts       int             `db:"attempts"`
+	NextAttemptAt  time.Time       `db:"next_attempt_at"`
+	LastStatusCode sql.NullInt64   `db:"last_status_code"`
+	LastError      sql.NullString  `db:"last_error"`
+	CreatedAt      time.Time       `db:"created_at"`
+	UpdatedAt      time.Time       `db:"updated_at"`
+}
+
+type Payment struct {
+	RideID        string         `db:"ride_id"`
+	UserID        string         `db:"user_id"`
+	Amount        int            `db:"amount"`
+	Status        string         `db:"status"`
+	Attempts      int            `db:"attempts"`
+	NextAttemptAt time.Time      `db:"next_attempt_at"`
+	LastError     sql.NullString `db:"last_error"`
+	Token         sql.NullString `db:"token"`
+	CreatedAt     time.Time      `db:"created_at"`
+	UpdatedAt     time.Time      `db:"updated_at"`
+}
+
+type Refund struct {
+	ID            string         `db:"id"`
+	RideID        string         `db:"ride_id"`
+	Amount        int            `db:"amount"`
+	Reason        string         `db:"reason"`
+	RequestedBy   string         `db:"requested_by"`
+	Status        string         `db:"status"`
+	Attempts      int            `db:"attempts"`
+	NextAttemptAt time.Time      `db:"next_attempt_at"`
+	LastError     sql.NullString `db:"last_error"`
+	CreatedAt     time.Time      `db:"created_at"`
+	UpdatedAt     time.Time      `db:"updated_at"`
 }
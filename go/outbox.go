@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ライドのイベントは状態の変更と同じトランザクションで ride_event_outbox に書き込み、
+// コミット後に outboxDispatcher が EventBus に配送する
+// 配送してから delivered_at を記録するまでの間にプロセスが落ちた場合は再起動後にもう一度配送する(at-least-once)
+// 購読者は RideStatusID で重複を取り除くこと
+
+const (
+	outboxPollInterval  = time.Second
+	outboxPurgeInterval = time.Minute
+	outboxRetention     = time.Hour
+	outboxBatchSize     = 100
+)
+
+type outboxDispatcher struct {
+	triggeredLoop
+
+	// purgedAt はループの中からだけ読み書きする
+	purgedAt time.Time
+}
+
+var outbox = &outboxDispatcher{}
+
+type outboxEvent struct {
+	ID      int64           `db:"id"`
+	Topic   string          `db:"topic"`
+	Payload json.RawMessage `db:"payload"`
+}
+
+// insertRideEvent は tx の中で topic 宛てのイベントをアウトボックスに書き込む
+// コミット後に outbox.Trigger() を呼ぶとすぐに配送される
+func insertRideEvent(ctx context.Context, tx *sqlx.Tx, topic string, data RideStatusEventData) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO ride_event_outbox (topic, payload) VALUES (?, ?)`, topic, payload)
+	return err
+}
+
+// insertChairRideEvent は椅子とそのオーナー宛てのイベントをアウトボックスに書き込む
+func insertChairRideEvent(ctx context.Context, tx *sqlx.Tx, chairID string, data RideStatusEventData) error {
+	if err := insertRideEvent(ctx, tx, chairTopic(chairID), data); err != nil {
+		return err
+	}
+	ownerID := ""
+	if err := tx.GetContext(ctx, &ownerID, `SELECT owner_id FROM chairs WHERE id = ?`, chairID); err != nil {
+		return err
+	}
+	return insertRideEvent(ctx, tx, ownerTopic(ownerID), data)
+}
+
+func (d *outboxDispatcher) Start() {
+	d.triggeredLoop.Start(outboxPollInterval, func(ctx context.Context) {
+		if _, err := d.DispatchOnce(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("failed to dispatch outbox events", slog.Any("err", err))
+		}
+		if time.Since(d.purgedAt) >= outboxPurgeInterval {
+			d.purgedAt = time.Now()
+			if _, err := db.ExecContext(ctx, `DELETE FROM ride_event_outbox WHERE delivered_at < ?`, time.Now().Add(-outboxRetention)); err != nil && ctx.Err() == nil {
+				slog.Error("failed to purge outbox", slog.Any("err", err))
+			}
+		}
+	})
+}
+
+// DispatchOnce は未配送のイベントを全て EventBus に配送し、配送した件数を返す
+func (d *outboxDispatcher) DispatchOnce(ctx context.Context) (int, error) {
+	d.runMu.Lock()
+	defer d.runMu.Unlock()
+
+	dispatched := 0
+	for {
+		n, err := d.dispatchBatch(ctx)
+		dispatched += n
+		if err != nil || n < outboxBatchSize {
+			return dispatched, err
+		}
+	}
+}
+
+// 複数台で動かしている場合に同じイベントを二重に配送しないよう、配送中の行はロックしておく
+func (d *outboxDispatcher) dispatchBatch(ctx context.Context) (int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	events := []outboxEvent{}
+	if err := tx.SelectContext(ctx, &events, `SELECT id, topic, payload FROM ride_event_outbox WHERE delivered_at IS NULL ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED`, outboxBatchSize); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]int64, 0, len(events))
+	for _, e := range events {
+		ids = append(ids, e.ID)
+		data := RideStatusEventData{}
+		if err := json.Unmarshal(e.Payload, &data); err != nil {
+			// 壊れたイベントは配送せずに読み飛ばす
+			slog.Error("failed to decode outbox event", slog.Int64("id", e.ID), slog.Any("err", err))
+			continue
+		}
+		rideStatusEvents.Publish(e.Topic, data)
+	}
+
+	query, args, err := sqlx.In(`UPDATE ride_event_outbox SET delivered_at = NOW(6) WHERE id IN (?)`, ids)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
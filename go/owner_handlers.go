@@ -2,9 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/oklog/ulid/v2"
@@ -115,6 +120,12 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	refunded, err := getRefundedAmounts(ctx, tx, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	res := ownerGetSalesResponse{
 		TotalSales: 0,
 	}
@@ -127,7 +138,7 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		sales := sumSales(rides)
+		sales := sumSales(rides, refunded)
 		res.TotalSales += sales
 
 		res.Chairs = append(res.Chairs, chairSales{
@@ -151,10 +162,12 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, res)
 }
 
-func sumSales(rides []Ride) int {
+// 売上はクーポンで割り引く前の運賃で数え、返金したライドは返金額を差し引く
+// 返金は割引後の決済額(payments.amount)までしかできないが、割引の分は運営が負担するので売上からは引かない
+func sumSales(rides []Ride, refunded map[string]int) int {
 	sale := 0
 	for _, ride := range rides {
-		sale += calculateSale(ride)
+		sale += calculateSale(ride) - refunded[ride.ID]
 	}
 	return sale
 }
@@ -260,3 +273,350 @@ WHERE c.owner_id = ?
 	}
 	writeJSON(w, http.StatusOK, res)
 }
+
+type ownerStreamEvent struct {
+	// chair_status, ride_completed, chair_location, chair_activity のいずれか
+	Type       string      `json:"type"`
+	ChairID    string      `json:"chair_id"`
+	RideID     string      `json:"ride_id,omitempty"`
+	Status     string      `json:"status,omitempty"`
+	Sale       *int        `json:"sale,omitempty"`
+	Coordinate *Coordinate `json:"coordinate,omitempty"`
+	Active     *bool       `json:"active,omitempty"`
+	Timestamp  int64       `json:"timestamp"`
+}
+
+// アウトボックスは配送済みにする前に失敗した場合に同じイベントを配送し直す。再配送は次のポーリングで
+// 起きるので、送ったイベントのIDはこの間だけ覚えておけばよい
+const ownerStreamDedupWindow = time.Minute
+
+// SSE でオーナーの椅子の状態変化、ライドの完了と売上、位置情報の更新を通知する
+func ownerGetStream(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	statusSub := rideStatusEvents.Subscribe(ownerTopic(owner.ID))
+	defer statusSub.Unsubscribe()
+	locationSub := chairLocationEvents.Subscribe(ownerTopic(owner.ID))
+	defer locationSub.Unsubscribe()
+	activitySub := chairActivityEvents.Subscribe(ownerTopic(owner.ID))
+	defer activitySub.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(id string, events ...ownerStreamEvent) error {
+		for _, e := range events {
+			if err := writeSSEEvent(w, id, e); err != nil {
+				return err
+			}
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	// アウトボックスからの配送は重複することがある。送った時刻を覚えておき、古くなったものから捨てる
+	sent := map[string]time.Time{}
+	pruneTicker := time.NewTicker(ownerStreamDedupWindow)
+	defer pruneTicker.Stop()
+	for {
+		var err error
+		select {
+		case e, ok := <-statusSub.C:
+			// 遅い購読者として打ち切られた場合は接続を閉じ、再接続させる
+			if !ok {
+				return
+			}
+			if _, ok := sent[e.Data.RideStatusID]; ok {
+				continue
+			}
+			sent[e.Data.RideStatusID] = time.Now()
+
+			ride := e.Data.Ride
+			events := []ownerStreamEvent{{
+				Type:      "chair_status",
+				ChairID:   ride.ChairID.String,
+				RideID:    ride.ID,
+				Status:    string(e.Data.Status),
+				Timestamp: ride.UpdatedAt.UnixMilli(),
+			}}
+			if e.Data.Status == RideStateCompleted {
+				// 返金は完了した後に行われるので、ここでは sumSales と同じ割引前の運賃を送る
+				sale := calculateSale(ride)
+				events = append(events, ownerStreamEvent{
+					Type:      "ride_completed",
+					ChairID:   ride.ChairID.String,
+					RideID:    ride.ID,
+					Sale:      &sale,
+					Timestamp: ride.UpdatedAt.UnixMilli(),
+				})
+			}
+			err = send(e.Data.RideStatusID, events...)
+		case e, ok := <-locationSub.C:
+			if !ok {
+				return
+			}
+			coordinate := e.Data.Coordinate
+			err = send("", ownerStreamEvent{
+				Type:       "chair_location",
+				ChairID:    e.Data.ChairID,
+				Coordinate: &coordinate,
+				Timestamp:  e.Data.RecordedAt.UnixMilli(),
+			})
+		case e, ok := <-activitySub.C:
+			if !ok {
+				return
+			}
+			active := e.Data.IsActive
+			err = send("", ownerStreamEvent{
+				Type:      "chair_activity",
+				ChairID:   e.Data.ChairID,
+				Active:    &active,
+				Timestamp: time.Now().UnixMilli(),
+			})
+		case <-pruneTicker.C:
+			for id, sentAt := range sent {
+				if time.Since(sentAt) > ownerStreamDedupWindow {
+					delete(sent, id)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			slog.Error("failed to send owner stream event", slog.Any("err", err))
+			return
+		}
+	}
+}
+
+type ownerPostWebhookRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+type ownerWebhookResponse struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+func newOwnerWebhookResponse(hook *OwnerWebhook) ownerWebhookResponse {
+	return ownerWebhookResponse{
+		ID:        hook.ID,
+		URL:       hook.URL,
+		Events:    strings.Split(hook.Events, ","),
+		CreatedAt: hook.CreatedAt.UnixMilli(),
+	}
+}
+
+// Webhook を登録する。secret を省略した場合は生成し、登録時のレスポンスでのみ返す
+func ownerPostWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerPostWebhookRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateWebhookURL(req.URL); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Events) == 0 {
+		req.Events = webhookEventTypes
+	}
+	for _, e := range req.Events {
+		if !slices.Contains(webhookEventTypes, e) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown event type: %s", e))
+			return
+		}
+	}
+	if req.Secret == "" {
+		req.Secret = secureRandomStr(32)
+	}
+
+	hookID := ulid.Make().String()
+	if _, err := db.ExecContext(ctx,
+		`INSERT INTO owner_webhooks (id, owner_id, url, secret, events) VALUES (?, ?, ?, ?, ?)`,
+		hookID, owner.ID, req.URL, req.Secret, strings.Join(slices.Compact(slices.Sorted(slices.Values(req.Events))), ","),
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	hook := &OwnerWebhook{}
+	if err := db.GetContext(ctx, hook, `SELECT * FROM owner_webhooks WHERE id = ?`, hookID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := newOwnerWebhookResponse(hook)
+	res.Secret = hook.Secret
+	writeJSON(w, http.StatusCreated, &res)
+}
+
+type ownerGetWebhooksResponse struct {
+	Webhooks []ownerWebhookResponse `json:"webhooks"`
+}
+
+func ownerGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	hooks := []OwnerWebhook{}
+	if err := db.SelectContext(ctx, &hooks, `SELECT * FROM owner_webhooks WHERE owner_id = ? ORDER BY created_at`, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetWebhooksResponse{Webhooks: []ownerWebhookResponse{}}
+	for _, hook := range hooks {
+		res.Webhooks = append(res.Webhooks, newOwnerWebhookResponse(&hook))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Webhook の登録を削除する。まだ送っていない配送と配送履歴も削除する
+func ownerDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	hookID := r.PathValue("webhook_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM owner_webhooks WHERE id = ? AND owner_id = ?`, hookID, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		writeError(w, http.StatusNotFound, errors.New("webhook not found"))
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM owner_webhook_deliveries WHERE webhook_id = ?`, hookID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerGetWebhookDeliveriesResponse struct {
+	Deliveries []ownerWebhookDeliveryResponse `json:"deliveries"`
+}
+
+type ownerWebhookDeliveryResponse struct {
+	ID             int64           `json:"id"`
+	EventID        string          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *int64          `json:"next_attempt_at,omitempty"`
+	LastStatusCode *int64          `json:"last_status_code,omitempty"`
+	LastError      *string         `json:"last_error,omitempty"`
+	CreatedAt      int64           `json:"created_at"`
+	UpdatedAt      int64           `json:"updated_at"`
+}
+
+const ownerWebhookDeliveriesLimit = 100
+
+// Webhook の配送履歴を新しい順に返す
+func ownerGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	hookID := r.PathValue("webhook_id")
+
+	hook := &OwnerWebhook{}
+	if err := db.GetContext(ctx, hook, `SELECT * FROM owner_webhooks WHERE id = ? AND owner_id = ?`, hookID, owner.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("webhook not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	deliveries := []OwnerWebhookDelivery{}
+	if err := db.SelectContext(ctx, &deliveries, `SELECT * FROM owner_webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?`, hook.ID, ownerWebhookDeliveriesLimit); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetWebhookDeliveriesResponse{Deliveries: []ownerWebhookDeliveryResponse{}}
+	for _, d := range deliveries {
+		item := ownerWebhookDeliveryResponse{
+			ID:        d.ID,
+			EventID:   d.EventID,
+			EventType: d.EventType,
+			Payload:   d.Payload,
+			Status:    d.Status,
+			Attempts:  d.Attempts,
+			CreatedAt: d.CreatedAt.UnixMilli(),
+			UpdatedAt: d.UpdatedAt.UnixMilli(),
+		}
+		if d.Status == "PENDING" {
+			t := d.NextAttemptAt.UnixMilli()
+			item.NextAttemptAt = &t
+		}
+		if d.LastStatusCode.Valid {
+			item.LastStatusCode = &d.LastStatusCode.Int64
+		}
+		if d.LastError.Valid {
+			item.LastError = &d.LastError.String
+		}
+		res.Deliveries = append(res.Deliveries, item)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// ownerPostRideRefund はオーナーの椅子が担当したライドの決済を返金する
+func ownerPostRideRefund(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	rideID := r.PathValue("ride_id")
+
+	ownerID := ""
+	if err := db.GetContext(ctx, &ownerID, `SELECT chairs.owner_id FROM rides JOIN chairs ON chairs.id = rides.chair_id WHERE rides.id = ?`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ownerID != owner.ID {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+
+	writeRefund(w, r, rideID, RefundRequestedByOwner)
+}
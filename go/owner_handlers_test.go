@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// 割引前の運賃が 1500 のライド(原点から距離 10)
+func newTestDiscountedRide() Ride {
+	return Ride{ID: ulid.Make().String(), UserID: ulid.Make().String(), DestinationLatitude: 4, DestinationLongitude: 6}
+}
+
+func TestSumSalesSubtractsRefundsFromGrossFare(t *testing.T) {
+	ride := newTestDiscountedRide()
+	other := Ride{ID: ulid.Make().String(), DestinationLatitude: 1}
+	if got := calculateSale(ride); got != 1500 {
+		t.Fatalf("calculateSale() = %d, want 1500", got)
+	}
+
+	// 1000 に割り引かれて決済されたライドから 300 を返金しても、売上は割引前の運賃から差し引く
+	if got := sumSales([]Ride{ride, other}, map[string]int{ride.ID: 300}); got != 1200+calculateSale(other) {
+		t.Errorf("sumSales() = %d, want %d", got, 1200+calculateSale(other))
+	}
+}
+
+// 割引されたライドの返金は決済額までに制限され、売上は割引前の運賃から返金額を引いたものになる
+func TestRefundDiscountedRide(t *testing.T) {
+	setupTestDB(t)
+	mockURL := startPaymentMock(t)
+	usePaymentMock(t, mockURL)
+	ctx := context.Background()
+
+	ride := newTestDiscountedRide()
+	token := ulid.Make().String()
+	if _, err := db.ExecContext(ctx, `INSERT INTO payments (ride_id, user_id, amount, status, token) VALUES (?, ?, ?, ?, ?)`, ride.ID, ride.UserID, 1000, PaymentStatusSucceeded, token); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.ExecContext(ctx, `DELETE FROM refunds WHERE ride_id = ?`, ride.ID)
+		db.ExecContext(ctx, `DELETE FROM payments WHERE ride_id = ?`, ride.ID)
+	})
+	if err := paymentGateway.PostPayment(ctx, mockURL, token, ride.ID, &paymentGatewayPostPaymentRequest{Amount: 1000}); err != nil {
+		t.Fatal(err)
+	}
+
+	partial := 300
+	refund, err := refundRide(ctx, ride.ID, &partial, "late pickup", RefundRequestedByOwner)
+	if err != nil || refund.Status != RefundStatusSucceeded {
+		t.Fatalf("refundRide(300) = %+v, %v, want SUCCEEDED", refund, err)
+	}
+
+	refunded := 0
+	if err := db.GetContext(ctx, &refunded, `SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE ride_id = ? AND status != ?`, ride.ID, RefundStatusFailed); err != nil {
+		t.Fatal(err)
+	}
+	if got := sumSales([]Ride{ride}, map[string]int{ride.ID: refunded}); got != 1200 {
+		t.Errorf("sales after refunding 300 = %d, want 1200", got)
+	}
+
+	// 割引前の運賃が残っていても、決済された 1000 のうち残りの 700 を超えては返金できない
+	tooMuch := 1000
+	if _, err := refundRide(ctx, ride.ID, &tooMuch, "again", RefundRequestedByOwner); !errors.Is(err, errRefundExceedsPayment) {
+		t.Errorf("refundRide(1000) = %v, want %v", err, errRefundExceedsPayment)
+	}
+}
@@ -6,92 +6,364 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 )
 
 var erroredUpstream = errors.New("errored upstream")
 
+// errPaymentRejected は決済トークンや決済額が不正などで、リトライしても成功しない決済であることを表す
+var errPaymentRejected = errors.New("payment rejected")
+
+// errPaymentCircuitOpen は社内決済マイクロサービスの異常が続いているため、リクエストを送らなかったことを表す
+var errPaymentCircuitOpen = fmt.Errorf("payment gateway circuit is open. %w", erroredUpstream)
+
 type paymentGatewayPostPaymentRequest struct {
 	Amount int `json:"amount"`
 }
 
 type paymentGatewayGetPaymentsResponseOne struct {
-	Amount int    `json:"amount"`
-	Status string `json:"status"`
+	Amount         int    `json:"amount"`
+	Status         string `json:"status"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+const (
+	defaultPaymentGatewayTimeout        = 3 * time.Second
+	defaultPaymentGatewayMaxConcurrency = 8
+	paymentGatewayMaxRetries            = 5
+	paymentGatewayBaseBackoff           = 100 * time.Millisecond
+	paymentGatewayMaxBackoff            = 2 * time.Second
+	paymentGatewayFailureThreshold      = 5
+	paymentGatewayOpenDuration          = 5 * time.Second
+)
+
+// paymentGatewayClient は社内決済マイクロサービスのクライアント
+// 社内決済マイクロサービスは同時にたくさんリクエストすると変なことになるので、同時に送るリクエスト数を制限する
+// 失敗が続いた場合はサーキットブレーカーを開き、しばらくの間リクエストを送らずに失敗させる
+type paymentGatewayClient struct {
+	client  *http.Client
+	sem     chan struct{}
+	breaker *circuitBreaker
+}
+
+// ISUCON_PAYMENT_TIMEOUT (秒) と ISUCON_PAYMENT_MAX_CONCURRENCY からクライアントを作る
+func newPaymentGatewayClientFromEnv() *paymentGatewayClient {
+	timeout := defaultPaymentGatewayTimeout
+	if v := os.Getenv("ISUCON_PAYMENT_TIMEOUT"); v != "" {
+		sec, err := strconv.ParseFloat(v, 64)
+		if err != nil || sec <= 0 {
+			slog.Warn("invalid ISUCON_PAYMENT_TIMEOUT, using default", slog.String("value", v))
+		} else {
+			timeout = time.Duration(sec * float64(time.Second))
+		}
+	}
+	concurrency := defaultPaymentGatewayMaxConcurrency
+	if v := os.Getenv("ISUCON_PAYMENT_MAX_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			slog.Warn("invalid ISUCON_PAYMENT_MAX_CONCURRENCY, using default", slog.String("value", v))
+		} else {
+			concurrency = n
+		}
+	}
+	return &paymentGatewayClient{
+		client:  &http.Client{Timeout: timeout},
+		sem:     make(chan struct{}, concurrency),
+		breaker: newCircuitBreaker(paymentGatewayFailureThreshold, paymentGatewayOpenDuration),
+	}
 }
 
-func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL string, token string, param *paymentGatewayPostPaymentRequest, retrieveRidesOrderByCreatedAtAsc func() ([]Ride, error)) error {
+var paymentGateway = newPaymentGatewayClientFromEnv()
+
+// PostPayment は idempotencyKey を Idempotency-Key として決済を行う
+// 同じキーの決済は社内決済マイクロサービス側で一度しか行われないので、結果が分からなかった場合はバックオフしながらリトライする
+func (c *paymentGatewayClient) PostPayment(ctx context.Context, paymentGatewayURL string, token string, idempotencyKey string, param *paymentGatewayPostPaymentRequest) error {
+	return c.post(ctx, paymentGatewayURL, "/payments", token, idempotencyKey, param)
+}
+
+type paymentGatewayPostRefundRequest struct {
+	Amount int `json:"amount"`
+}
+
+// PostRefund は paymentKey を Idempotency-Key として行った決済の一部または全部を返金する
+// 返金も refundKey を Idempotency-Key とするので、リトライしても二重に返金されることはない
+func (c *paymentGatewayClient) PostRefund(ctx context.Context, paymentGatewayURL string, token string, paymentKey string, refundKey string, param *paymentGatewayPostRefundRequest) error {
+	return c.post(ctx, paymentGatewayURL, "/payments/"+url.PathEscape(paymentKey)+"/refund", token, refundKey, param)
+}
+
+func (c *paymentGatewayClient) post(ctx context.Context, paymentGatewayURL string, path string, token string, idempotencyKey string, param any) error {
 	b, err := json.Marshal(param)
 	if err != nil {
 		return err
 	}
 
-	// 失敗したらとりあえずリトライ
-	// FIXME: 社内決済マイクロサービスのインフラに異常が発生していて、同時にたくさんリクエストすると変なことになる可能性あり
-	retry := 0
-	for {
-		err := func() error {
-			req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentGatewayURL+"/payments", bytes.NewBuffer(b))
-			if err != nil {
-				return err
-			}
-			req.Header.Set("Content-Type", "application/json")
-			req.Header.Set("Authorization", "Bearer "+token)
-
-			res, err := http.DefaultClient.Do(req)
-			if err != nil {
-				return err
-			}
-			defer res.Body.Close()
-
-			if res.StatusCode != http.StatusNoContent {
-				// エラーが返ってきても成功している場合があるので、社内決済マイクロサービスに問い合わせ
-				getReq, err := http.NewRequestWithContext(ctx, http.MethodGet, paymentGatewayURL+"/payments", bytes.NewBuffer([]byte{}))
-				if err != nil {
-					return err
-				}
-				getReq.Header.Set("Authorization", "Bearer "+token)
-
-				getRes, err := http.DefaultClient.Do(getReq)
-				if err != nil {
-					return err
-				}
-				defer res.Body.Close()
-
-				// GET /payments は障害と関係なく200が返るので、200以外は回復不能なエラーとする
-				if getRes.StatusCode != http.StatusOK {
-					return fmt.Errorf("[GET /payments] unexpected status code (%d)", getRes.StatusCode)
-				}
-				var payments []paymentGatewayGetPaymentsResponseOne
-				if err := json.NewDecoder(getRes.Body).Decode(&payments); err != nil {
-					return err
-				}
-
-				rides, err := retrieveRidesOrderByCreatedAtAsc()
-				if err != nil {
-					return err
-				}
-
-				if len(rides) != len(payments) {
-					return fmt.Errorf("unexpected number of payments: %d != %d. %w", len(rides), len(payments), erroredUpstream)
-				}
-
-				return nil
-			}
+	return retryPaymentGateway(ctx, func() error {
+		return c.postOnce(ctx, paymentGatewayURL, path, token, idempotencyKey, b)
+	})
+}
+
+// GetPayments は token で行われた決済の一覧を取得する
+func (c *paymentGatewayClient) GetPayments(ctx context.Context, paymentGatewayURL string, token string) ([]paymentGatewayGetPaymentsResponseOne, error) {
+	var payments []paymentGatewayGetPaymentsResponseOne
+	err := retryPaymentGateway(ctx, func() error {
+		var err error
+		payments, err = c.getPaymentsOnce(ctx, paymentGatewayURL, token)
+		return err
+	})
+	return payments, err
+}
+
+// retryPaymentGateway は結果が分からなかったリクエストをバックオフしながらリトライする
+func retryPaymentGateway(ctx context.Context, f func() error) error {
+	for retry := 0; ; retry++ {
+		err := f()
+		if err == nil {
 			return nil
-		}()
-		if err != nil {
-			if retry < 5 {
-				retry++
-				time.Sleep(100 * time.Millisecond)
-				continue
-			} else {
-				return err
-			}
 		}
-		break
+		if errors.Is(err, errPaymentRejected) || errors.Is(err, errPaymentCircuitOpen) || retry >= paymentGatewayMaxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(paymentGatewayBackoff(retry)):
+		}
 	}
+}
 
-	return nil
+// paymentGatewayBackoff は retry 回目の失敗の後に待つ時間。full jitter で同時に失敗したリクエストのリトライをばらけさせる
+func paymentGatewayBackoff(retry int) time.Duration {
+	backoff := paymentGatewayBaseBackoff << retry
+	if backoff <= 0 || backoff > paymentGatewayMaxBackoff {
+		backoff = paymentGatewayMaxBackoff
+	}
+	return rand.N(backoff) + time.Millisecond
+}
+
+func (c *paymentGatewayClient) postOnce(ctx context.Context, paymentGatewayURL string, path string, token string, idempotencyKey string, body []byte) error {
+	if !c.breaker.Allow() {
+		return errPaymentCircuitOpen
+	}
+
+	select {
+	case c.sem <- struct{}{}:
+		defer func() { <-c.sem }()
+	case <-ctx.Done():
+		c.breaker.Cancel()
+		return ctx.Err()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentGatewayURL+path, bytes.NewBuffer(body))
+	if err != nil {
+		c.breaker.Cancel()
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		c.breaker.Failure()
+		return fmt.Errorf("[POST %s] %w. %w", path, err, erroredUpstream)
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNoContent:
+		c.breaker.Success()
+		return nil
+	case res.StatusCode == http.StatusConflict:
+		// 同じキーのリクエストがまだ処理中なので、終わるのを待ってリトライする
+		c.breaker.Success()
+		return fmt.Errorf("[POST %s] request with the same key is in progress. %w", path, erroredUpstream)
+	case res.StatusCode >= 400 && res.StatusCode < 500:
+		c.breaker.Success()
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("[POST %s] unexpected status code (%d): %s. %w", path, res.StatusCode, body, errPaymentRejected)
+	default:
+		c.breaker.Failure()
+		return fmt.Errorf("[POST %s] unexpected status code (%d). %w", path, res.StatusCode, erroredUpstream)
+	}
+}
+
+func (c *paymentGatewayClient) getPaymentsOnce(ctx context.Context, paymentGatewayURL string, token string) ([]paymentGatewayGetPaymentsResponseOne, error) {
+	if !c.breaker.Allow() {
+		return nil, errPaymentCircuitOpen
+	}
+
+	select {
+	case c.sem <- struct{}{}:
+		defer func() { <-c.sem }()
+	case <-ctx.Done():
+		c.breaker.Cancel()
+		return nil, ctx.Err()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, paymentGatewayURL+"/payments", nil)
+	if err != nil {
+		c.breaker.Cancel()
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		c.breaker.Failure()
+		return nil, fmt.Errorf("[GET /payments] %w. %w", err, erroredUpstream)
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		c.breaker.Success()
+		payments := []paymentGatewayGetPaymentsResponseOne{}
+		if err := json.NewDecoder(res.Body).Decode(&payments); err != nil {
+			return nil, fmt.Errorf("[GET /payments] %w. %w", err, erroredUpstream)
+		}
+		return payments, nil
+	case res.StatusCode >= 400 && res.StatusCode < 500:
+		c.breaker.Success()
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("[GET /payments] unexpected status code (%d): %s. %w", res.StatusCode, body, errPaymentRejected)
+	default:
+		c.breaker.Failure()
+		return nil, fmt.Errorf("[GET /payments] unexpected status code (%d). %w", res.StatusCode, erroredUpstream)
+	}
+}
+
+type paymentGatewayStats struct {
+	CircuitBreaker circuitBreakerStats `json:"circuit_breaker"`
+	InFlight       int                 `json:"in_flight"`
+	MaxConcurrency int                 `json:"max_concurrency"`
+}
+
+func (c *paymentGatewayClient) Stats() paymentGatewayStats {
+	return paymentGatewayStats{
+		CircuitBreaker: c.breaker.Stats(),
+		InFlight:       len(c.sem),
+		MaxConcurrency: cap(c.sem),
+	}
+}
+
+type circuitBreakerState string
+
+const (
+	circuitClosed   circuitBreakerState = "closed"
+	circuitOpen     circuitBreakerState = "open"
+	circuitHalfOpen circuitBreakerState = "half_open"
+)
+
+// circuitBreaker は threshold 回続けて失敗したら開き、openDuration の間は全てのリクエストを拒否する
+// その後は一つだけリクエストを通し(half_open)、成功すれば閉じ、失敗すればまた開く
+type circuitBreaker struct {
+	mu                  sync.Mutex
+	state               circuitBreakerState
+	consecutiveFailures int
+	openedAt            time.Time
+	probing             bool
+
+	threshold    int
+	openDuration time.Duration
+
+	opened   int64
+	rejected int64
+}
+
+type circuitBreakerStats struct {
+	State               circuitBreakerState `json:"state"`
+	ConsecutiveFailures int                 `json:"consecutive_failures"`
+	Opened              int64               `json:"opened"`
+	Rejected            int64               `json:"rejected"`
+}
+
+func newCircuitBreaker(threshold int, openDuration time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		state:        circuitClosed,
+		threshold:    threshold,
+		openDuration: openDuration,
+	}
+}
+
+// Allow はリクエストを送ってよいかを返す。true の場合は Success, Failure, Cancel のいずれかを呼ぶこと
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitOpen && time.Since(b.openedAt) >= b.openDuration {
+		b.state = circuitHalfOpen
+	}
+	switch b.state {
+	case circuitOpen:
+		b.rejected++
+		return false
+	case circuitHalfOpen:
+		if b.probing {
+			b.rejected++
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != circuitClosed {
+		slog.Info("payment gateway circuit closed")
+	}
+	b.state = circuitClosed
+	b.consecutiveFailures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.consecutiveFailures++
+	b.probing = false
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.consecutiveFailures >= b.threshold) {
+		if b.state == circuitClosed {
+			slog.Warn("payment gateway circuit opened", slog.Int("consecutive_failures", b.consecutiveFailures))
+		}
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+		b.opened++
+	}
+}
+
+// Cancel は Allow の後にリクエストを送らなかったことを表す
+func (b *circuitBreaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+func (b *circuitBreaker) Stats() circuitBreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.state
+	if state == circuitOpen && time.Since(b.openedAt) >= b.openDuration {
+		state = circuitHalfOpen
+	}
+	return circuitBreakerStats{
+		State:               state,
+		ConsecutiveFailures: b.consecutiveFailures,
+		Opened:              b.opened,
+		Rejected:            b.rejected,
+	}
 }
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// expireOpen は開いているサーキットブレーカーの openDuration を経過させる
+func expireOpen(b *circuitBreaker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.openedAt = time.Now().Add(-b.openDuration)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(3, time.Minute)
+
+	// 閾値に達するまでは閉じたまま
+	for range 2 {
+		if !b.Allow() {
+			t.Fatal("Allow() = false while closed")
+		}
+		b.Failure()
+	}
+	if got := b.Stats().State; got != circuitClosed {
+		t.Fatalf("state = %s after 2 failures, want %s", got, circuitClosed)
+	}
+
+	// 成功すると連続失敗数は数え直しになる
+	b.Allow()
+	b.Success()
+	for range 2 {
+		b.Allow()
+		b.Failure()
+	}
+	if got := b.Stats().State; got != circuitClosed {
+		t.Fatalf("state = %s after a success and 2 failures, want %s", got, circuitClosed)
+	}
+
+	b.Allow()
+	b.Failure()
+	if got := b.Stats(); got.State != circuitOpen || got.Opened != 1 {
+		t.Fatalf("stats = %+v after 3 consecutive failures, want open once", got)
+	}
+	if b.Allow() {
+		t.Fatal("Allow() = true while open")
+	}
+	if got := b.Stats().Rejected; got != 1 {
+		t.Errorf("rejected = %d, want 1", got)
+	}
+
+	// openDuration が過ぎたら一つだけ通す
+	expireOpen(b)
+	if got := b.Stats().State; got != circuitHalfOpen {
+		t.Fatalf("state = %s after openDuration, want %s", got, circuitHalfOpen)
+	}
+	if !b.Allow() {
+		t.Fatal("Allow() = false for the first request while half open")
+	}
+	if b.Allow() {
+		t.Fatal("Allow() = true for the second request while half open")
+	}
+
+	// 試しに通したリクエストが失敗したらまた開く
+	b.Failure()
+	if got := b.Stats(); got.State != circuitOpen || got.Opened != 2 {
+		t.Fatalf("stats = %+v after the probe failed, want open twice", got)
+	}
+
+	// 試しに通したリクエストを送らなかった場合は次のリクエストを通す
+	expireOpen(b)
+	if !b.Allow() {
+		t.Fatal("Allow() = false while half open")
+	}
+	b.Cancel()
+	if !b.Allow() {
+		t.Fatal("Allow() = false after the probe was canceled")
+	}
+
+	// 成功したら閉じる
+	b.Success()
+	if got := b.Stats(); got.State != circuitClosed || got.ConsecutiveFailures != 0 {
+		t.Fatalf("stats = %+v after the probe succeeded, want closed", got)
+	}
+	if !b.Allow() {
+		t.Fatal("Allow() = false after closing")
+	}
+	b.Success()
+}
+
+func TestPaymentGatewayClientOpensCircuit(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	c := &paymentGatewayClient{
+		client:  srv.Client(),
+		sem:     make(chan struct{}, 1),
+		breaker: newCircuitBreaker(2, time.Minute),
+	}
+	post := func() error {
+		return c.postOnce(context.Background(), srv.URL, "/payments", "token", "key", []byte(`{"amount":1000}`))
+	}
+
+	for range 2 {
+		if err := post(); !errors.Is(err, erroredUpstream) || errors.Is(err, errPaymentCircuitOpen) {
+			t.Fatalf("postOnce() = %v, want an upstream error", err)
+		}
+	}
+	// 開いている間は送らずに失敗させる
+	if err := post(); !errors.Is(err, errPaymentCircuitOpen) {
+		t.Fatalf("postOnce() = %v, want %v", err, errPaymentCircuitOpen)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("requests = %d, want 2", got)
+	}
+	// 開いている間はリトライしない
+	if err := c.PostPayment(context.Background(), srv.URL, "token", "key", &paymentGatewayPostPaymentRequest{Amount: 1000}); !errors.Is(err, errPaymentCircuitOpen) {
+		t.Fatalf("PostPayment() = %v, want %v", err, errPaymentCircuitOpen)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("requests = %d, want 2", got)
+	}
+}
+
+// newStatusServer は statuses の順にステータスコードを返すサーバーを起動する
+// statuses を使い切った後は最後のステータスコードを返し続ける
+func newStatusServer(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		w.WriteHeader(statuses[min(int(n), len(statuses))-1])
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestPostPaymentRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		threshold    int
+		wantRequests int64
+		wantErr      error
+	}{
+		{
+			name:         "succeeds after upstream errors",
+			statuses:     []int{http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusNoContent},
+			threshold:    10,
+			wantRequests: 3,
+		},
+		{
+			name:         "does not retry rejected payments",
+			statuses:     []int{http.StatusBadRequest},
+			threshold:    10,
+			wantRequests: 1,
+			wantErr:      errPaymentRejected,
+		},
+		{
+			name:         "gives up after the max retries",
+			statuses:     []int{http.StatusInternalServerError},
+			threshold:    10,
+			wantRequests: paymentGatewayMaxRetries + 1,
+			wantErr:      erroredUpstream,
+		},
+		{
+			name:         "does not retry while the circuit is open",
+			statuses:     []int{http.StatusInternalServerError},
+			threshold:    1,
+			wantRequests: 1,
+			wantErr:      errPaymentCircuitOpen,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := newStatusServer(t, tt.statuses...)
+			c := &paymentGatewayClient{
+				client:  srv.Client(),
+				sem:     make(chan struct{}, 1),
+				breaker: newCircuitBreaker(tt.threshold, time.Minute),
+			}
+			err := c.PostPayment(context.Background(), srv.URL, "token", "key", &paymentGatewayPostPaymentRequest{Amount: 1000})
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", got, tt.wantRequests)
+			}
+			if (tt.wantErr == nil && err != nil) || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPostPaymentStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		cancel()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	c := &paymentGatewayClient{
+		client:  srv.Client(),
+		sem:     make(chan struct{}, 1),
+		breaker: newCircuitBreaker(10, time.Minute),
+	}
+	err := c.PostPayment(ctx, srv.URL, "token", "key", &paymentGatewayPostPaymentRequest{Amount: 1000})
+	if got := requests.Load(); got != 1 || !errors.Is(err, context.Canceled) || !errors.Is(err, erroredUpstream) {
+		t.Errorf("requests = %d, err = %v, want one request canceled", got, err)
+	}
+}
+
+// startPaymentMock は ../payment_mock をビルドして起動する。テストごとに別のプロセスを起動するので請求は空から始まる
+func startPaymentMock(t *testing.T) string {
+	t.Helper()
+
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command is required to build payment_mock")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "payment_mock")
+	build := exec.Command(goCmd, "build", "-o", bin, ".")
+	build.Dir = filepath.Join("..", "payment_mock")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build payment_mock: %v\n%s", err, out)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := exec.Command(bin, "-addr", addr)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	mockURL := "http://" + addr
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		res, err := http.Get(mockURL + "/_control/faults")
+		if err == nil {
+			res.Body.Close()
+			return mockURL
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("payment_mock did not start: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// setPaymentMockFaults は payment_mock の障害の設定を丸ごと置き換える
+func setPaymentMockFaults(t *testing.T, mockURL string, faults string) {
+	t.Helper()
+
+	res, err := http.Post(mockURL+"/_control/faults", "application/json", strings.NewReader(faults))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("POST /_control/faults: unexpected status code (%d)", res.StatusCode)
+	}
+}
+
+// newTestPaymentGatewayClient はテスト中にサーキットブレーカーが開かないクライアントを作る
+func newTestPaymentGatewayClient() *paymentGatewayClient {
+	return &paymentGatewayClient{
+		client:  &http.Client{Timeout: time.Second},
+		sem:     make(chan struct{}, defaultPaymentGatewayMaxConcurrency),
+		breaker: newCircuitBreaker(1000, paymentGatewayOpenDuration),
+	}
+}
+
+// assertCharged は token で amounts の順に請求されていることを確かめる
+func assertCharged(t *testing.T, mockURL string, token string, amounts ...int) {
+	t.Helper()
+
+	payments, err := newTestPaymentGatewayClient().GetPayments(context.Background(), mockURL, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []int{}
+	for _, p := range payments {
+		got = append(got, p.Amount)
+	}
+	if !slices.Equal(got, amounts) {
+		t.Errorf("charged %v, want %v", got, amounts)
+	}
+}
+
+// 決済を記録した後に結果が返らなかった場合、同じ Idempotency-Key でのリトライは二重に請求しない
+func TestPostPaymentRetriesAfterRecordWithoutDoubleCharge(t *testing.T) {
+	mockURL := startPaymentMock(t)
+
+	for _, faults := range []string{`{"error_after_record": 1}`, `{"drop_connection": 1}`} {
+		t.Run(faults, func(t *testing.T) {
+			setPaymentMockFaults(t, mockURL, faults)
+			c := newTestPaymentGatewayClient()
+			token := ulid.Make().String()
+
+			// 障害は常に起きるので、リトライは同じキーの決済済みの応答で成功する
+			if err := c.PostPayment(context.Background(), mockURL, token, "ride1", &paymentGatewayPostPaymentRequest{Amount: 1000}); err != nil {
+				t.Fatalf("PostPayment() = %v, want the retry to succeed", err)
+			}
+			assertCharged(t, mockURL, token, 1000)
+
+			// 別のライドは別に請求される
+			if err := c.PostPayment(context.Background(), mockURL, token, "ride2", &paymentGatewayPostPaymentRequest{Amount: 500}); err != nil {
+				t.Fatal(err)
+			}
+			assertCharged(t, mockURL, token, 1000, 500)
+		})
+	}
+}
+
+// 決済を記録する前に失敗し続けた場合はリトライを諦め、後で同じ Idempotency-Key で送り直すと一度だけ請求される
+func TestPostPaymentGivesUpBeforeRecord(t *testing.T) {
+	mockURL := startPaymentMock(t)
+	setPaymentMockFaults(t, mockURL, `{"error_before_record": 1}`)
+	c := newTestPaymentGatewayClient()
+	token := ulid.Make().String()
+
+	err := c.PostPayment(context.Background(), mockURL, token, "ride1", &paymentGatewayPostPaymentRequest{Amount: 1000})
+	if !errors.Is(err, erroredUpstream) || errors.Is(err, errPaymentRejected) {
+		t.Fatalf("PostPayment() = %v, want an upstream error", err)
+	}
+	assertCharged(t, mockURL, token)
+
+	setPaymentMockFaults(t, mockURL, `{}`)
+	for range 2 {
+		if err := c.PostPayment(context.Background(), mockURL, token, "ride1", &paymentGatewayPostPaymentRequest{Amount: 1000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertCharged(t, mockURL, token, 1000)
+}
+
+// 同時に処理できる数を超えた決済は 503 で断られるが、リトライで一度だけ請求される
+func TestPostPaymentRetriesWhenOverloaded(t *testing.T) {
+	mockURL := startPaymentMock(t)
+	setPaymentMockFaults(t, mockURL, `{"max_concurrency": 1, "latency_ms": 50}`)
+	c := newTestPaymentGatewayClient()
+	token := ulid.Make().String()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.PostPayment(context.Background(), mockURL, token, fmt.Sprintf("ride%d", i), &paymentGatewayPostPaymentRequest{Amount: 100})
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("PostPayment(ride%d) = %v", i, err)
+		}
+	}
+	assertCharged(t, mockURL, token, 100, 100, 100)
+}
+
+// GetPayments は決済ごとに送った Idempotency-Key を返す
+func TestGetPaymentsReturnsIdempotencyKeys(t *testing.T) {
+	mockURL := startPaymentMock(t)
+	c := newTestPaymentGatewayClient()
+	token := ulid.Make().String()
+
+	for _, key := range []string{"ride1", "ride2", "ride1"} {
+		if err := c.PostPayment(context.Background(), mockURL, token, key, &paymentGatewayPostPaymentRequest{Amount: 1000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	payments, err := c.GetPayments(context.Background(), mockURL, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, p := range payments {
+		got = append(got, p.IdempotencyKey)
+	}
+	if !slices.Equal(got, []string{"ride1", "ride2"}) {
+		t.Errorf("idempotency keys = %v, want [ride1 ride2]", got)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	PaymentStatusPending   = "PENDING"
+	PaymentStatusSucceeded = "SUCCEEDED"
+	// PaymentStatusFailed の決済は利用者が決済トークンを登録し直すと再び PENDING になる
+	PaymentStatusFailed = "PAYMENT_FAILED"
+)
+
+// 決済はライドの完了やキャンセルと同じトランザクションで payments に PENDING として積み、
+// paymentQueue のワーカーが社内決済マイクロサービスに送る
+// ライドIDを Idempotency-Key とするので、同じライドを同じ決済トークンで何度送っても請求は一度だけになる
+// Idempotency-Key は決済トークンごとに扱われるので、結果が分からなかった決済は必ず同じ決済トークンで送り直す
+
+const (
+	defaultPaymentWorkers = 4
+	paymentPollInterval   = 500 * time.Millisecond
+	paymentBatchSize      = 50
+	paymentBaseBackoff    = time.Second
+	paymentMaxBackoff     = 10 * time.Minute
+	paymentClaimDuration  = time.Minute
+)
+
+// 決済処理は同時に一つだけ実行し、その中で workers 個ずつ並行して送る
+type paymentProcessor struct {
+	triggeredLoop
+
+	workers int
+}
+
+var paymentQueue = &paymentProcessor{
+	workers: paymentWorkersFromEnv(),
+}
+
+// ISUCON_PAYMENT_WORKERS から決済を並行して送る数を読み取る
+func paymentWorkersFromEnv() int {
+	v := os.Getenv("ISUCON_PAYMENT_WORKERS")
+	if v == "" {
+		return defaultPaymentWorkers
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		slog.Warn("invalid ISUCON_PAYMENT_WORKERS, using default", slog.String("value", v))
+		return defaultPaymentWorkers
+	}
+	return n
+}
+
+// enqueuePayment は tx の中でライドの決済を積む。コミット後に paymentQueue.Trigger() を呼ぶとすぐに処理される
+func enqueuePayment(ctx context.Context, tx *sqlx.Tx, ride *Ride, amount int) error {
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO payments (ride_id, user_id, amount, status) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE ride_id = ride_id`,
+		ride.ID, ride.UserID, amount, PaymentStatusPending,
+	)
+	return err
+}
+
+// retryFailedPayments は利用者の失敗した決済を積み直す
+// 失敗した決済は拒否されて請求されていないので、新しい決済トークンで送り直してよい
+func retryFailedPayments(ctx context.Context, userID string) error {
+	result, err := db.ExecContext(ctx,
+		`UPDATE payments SET status = ?, attempts = 0, next_attempt_at = NOW(6) WHERE user_id = ? AND status = ?`,
+		PaymentStatusPending, userID, PaymentStatusFailed,
+	)
+	if err != nil {
+		return err
+	}
+	if count, err := result.RowsAffected(); err == nil && count > 0 {
+		paymentQueue.Trigger()
+	}
+	return nil
+}
+
+func (p *paymentProcessor) Start() {
+	p.triggeredLoop.Start(paymentPollInterval, func(ctx context.Context) {
+		if err := p.ProcessOnce(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("failed to process payments", slog.Any("err", err))
+		}
+	})
+}
+
+// ProcessOnce は処理時刻を迎えた決済と返金を確保し、workers 個ずつ並行して送る
+func (p *paymentProcessor) ProcessOnce(ctx context.Context) error {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+
+	payments, err := claimPayments(ctx)
+	if err != nil {
+		return err
+	}
+	refunds, err := claimRefunds(ctx)
+	if err != nil {
+		return err
+	}
+
+	sem := make(chan struct{}, p.workers)
+	var wg sync.WaitGroup
+	for _, payment := range payments {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := processPayment(ctx, &payment); err != nil && ctx.Err() == nil {
+				slog.Error("failed to record payment", slog.String("ride_id", payment.RideID), slog.Any("err", err))
+			}
+		}()
+	}
+	for _, refund := range refunds {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := processRefund(ctx, &refund); err != nil && ctx.Err() == nil {
+				slog.Error("failed to record refund", slog.String("refund_id", refund.ID), slog.Any("err", err))
+			}
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// claimPayments は処理時刻を迎えた決済を claimWebhookDeliveries と同じ方法で確保する
+func claimPayments(ctx context.Context) ([]Payment, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	payments := []Payment{}
+	if err := tx.SelectContext(ctx, &payments, `
+		SELECT *
+		FROM payments
+		WHERE status = ?
+		  AND next_attempt_at <= NOW(6)
+		ORDER BY next_attempt_at
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED`, PaymentStatusPending, paymentBatchSize); err != nil {
+		return nil, err
+	}
+	if len(payments) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, 0, len(payments))
+	for _, p := range payments {
+		ids = append(ids, p.RideID)
+	}
+	query, args, err := sqlx.In(`UPDATE payments SET attempts = attempts + 1, next_attempt_at = ? WHERE ride_id IN (?)`, time.Now().Add(paymentClaimDuration), ids)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for i := range payments {
+		payments[i].Attempts++
+	}
+	return payments, nil
+}
+
+// postPaymentWithFallback は既定の決済トークンから順に決済を送る
+// 決済トークンが拒否された場合だけ次の決済トークンを試す。結果が分からなかった場合は同じ決済トークンで送り直す必要があるので、そこで止める
+// 前に結果が分からなかった決済トークンがあれば、結果が分かるまではそれだけを使う
+func postPaymentWithFallback(ctx context.Context, payment *Payment) error {
+	tokens := []string{}
+	if payment.Token.Valid {
+		tokens = append(tokens, payment.Token.String)
+	}
+	registered := []string{}
+	if err := db.SelectContext(ctx, &registered, `SELECT token FROM payment_tokens WHERE user_id = ? ORDER BY is_default DESC, created_at`, payment.UserID); err != nil {
+		return err
+	}
+	for _, token := range registered {
+		if !slices.Contains(tokens, token) {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == 0 {
+		return errPaymentTokenNotRegistered
+	}
+
+	var errs []error
+	for _, token := range tokens {
+		// 結果が分からなかった場合に同じ決済トークンで送り直せるよう、送る前に記録しておく
+		if token != payment.Token.String {
+			if _, err := db.ExecContext(ctx, `UPDATE payments SET token = ? WHERE ride_id = ?`, token, payment.RideID); err != nil {
+				return err
+			}
+			payment.Token = sql.NullString{String: token, Valid: true}
+		}
+		err := paymentGateway.PostPayment(ctx, paymentGatewayURL, token, payment.RideID, &paymentGatewayPostPaymentRequest{Amount: payment.Amount})
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+		if !errors.Is(err, errPaymentRejected) {
+			break
+		}
+	}
+	// 最後の決済トークンのエラーでリトライするかを決める
+	last := errs[len(errs)-1]
+	if len(errs) > 1 && !errors.Is(last, errPaymentRejected) {
+		return fmt.Errorf("%w (rejected: %v)", last, errors.Join(errs[:len(errs)-1]...))
+	}
+	return errors.Join(errs...)
+}
+
+// processPayment は決済を一度送り、結果を記録して利用者に通知する
+// 拒否された場合だけ失敗とし、結果が分からなかった場合は分かるまで間隔を空けて同じ決済トークンで送り直す
+func processPayment(ctx context.Context, payment *Payment) error {
+	sendErr := postPaymentWithFallback(ctx, payment)
+	if ctx.Err() != nil {
+		// 停止中に送ったものは確保が切れた後に送り直す
+		return nil
+	}
+
+	if sendErr == nil {
+		if _, err := db.ExecContext(ctx, `UPDATE payments SET status = ?, last_error = NULL WHERE ride_id = ?`, PaymentStatusSucceeded, payment.RideID); err != nil {
+			return err
+		}
+		paymentEvents.Publish(userTopic(payment.UserID), PaymentEventData{
+			RideID: payment.RideID,
+			UserID: payment.UserID,
+			Amount: payment.Amount,
+			Status: PaymentStatusSucceeded,
+		})
+		return nil
+	}
+
+	// サーキットブレーカーが開いている間は送っていないので、試行回数に数えずに閉じるのを待つ
+	if errors.Is(sendErr, errPaymentCircuitOpen) {
+		_, err := db.ExecContext(ctx, `UPDATE payments SET attempts = attempts - 1, next_attempt_at = ? WHERE ride_id = ?`, time.Now().Add(paymentGatewayOpenDuration), payment.RideID)
+		return err
+	}
+
+	if !errors.Is(sendErr, errPaymentRejected) && !errors.Is(sendErr, errPaymentTokenNotRegistered) {
+		_, err := db.ExecContext(ctx, `UPDATE payments SET next_attempt_at = ?, last_error = ? WHERE ride_id = ?`, time.Now().Add(paymentBackoff(payment.Attempts)), sendErr.Error(), payment.RideID)
+		return err
+	}
+
+	// 拒否された決済は請求されていないので、決済トークンの記録を消して次は登録されている決済トークンから送り直す
+	slog.Warn("payment failed", slog.String("ride_id", payment.RideID), slog.Int("attempts", payment.Attempts), slog.Any("err", sendErr))
+	if _, err := db.ExecContext(ctx, `UPDATE payments SET status = ?, last_error = ?, token = NULL WHERE ride_id = ?`, PaymentStatusFailed, sendErr.Error(), payment.RideID); err != nil {
+		return err
+	}
+	paymentEvents.Publish(userTopic(payment.UserID), PaymentEventData{
+		RideID: payment.RideID,
+		UserID: payment.UserID,
+		Amount: payment.Amount,
+		Status: PaymentStatusFailed,
+		Error:  sendErr.Error(),
+	})
+	return nil
+}
+
+// paymentBackoff は attempts 回目に結果が分からなかった後に次を試すまでの時間
+// 結果が分かるまで送り直すので、間隔に上限を設ける
+func paymentBackoff(attempts int) time.Duration {
+	backoff := paymentBaseBackoff << (attempts - 1)
+	if backoff <= 0 || backoff > paymentMaxBackoff {
+		return paymentMaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// usePaymentMock はテストの間だけ決済の送り先を payment_mock に差し替える
+func usePaymentMock(t *testing.T, mockURL string) {
+	t.Helper()
+
+	origGateway, origURL := paymentGateway, paymentGatewayURL
+	paymentGateway, paymentGatewayURL = newTestPaymentGatewayClient(), mockURL
+	t.Cleanup(func() {
+		paymentGateway, paymentGatewayURL = origGateway, origURL
+	})
+}
+
+// insertTestPayment は決済トークンを登録した利用者と、その利用者の PENDING の決済を作る
+func insertTestPayment(t *testing.T, amount int) (*Payment, string) {
+	t.Helper()
+	ctx := context.Background()
+
+	userID := ulid.Make().String()
+	token := ulid.Make().String()
+	if _, err := db.ExecContext(ctx, `INSERT INTO payment_tokens (id, user_id, token, is_default) VALUES (?, ?, ?, 1)`, ulid.Make().String(), userID, token); err != nil {
+		t.Fatal(err)
+	}
+	payment := &Payment{RideID: ulid.Make().String(), UserID: userID, Amount: amount, Status: PaymentStatusPending}
+	if _, err := db.ExecContext(ctx, `INSERT INTO payments (ride_id, user_id, amount, status) VALUES (?, ?, ?, ?)`, payment.RideID, payment.UserID, payment.Amount, payment.Status); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.ExecContext(ctx, `DELETE FROM payments WHERE ride_id = ?`, payment.RideID)
+		db.ExecContext(ctx, `DELETE FROM payment_tokens WHERE user_id = ?`, userID)
+	})
+	return payment, token
+}
+
+// addTestPaymentToken は利用者に決済トークンを追加する
+func addTestPaymentToken(t *testing.T, userID string, isDefault bool) string {
+	t.Helper()
+	ctx := context.Background()
+
+	if isDefault {
+		if _, err := db.ExecContext(ctx, `UPDATE payment_tokens SET is_default = 0 WHERE user_id = ?`, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token := ulid.Make().String()
+	if _, err := db.ExecContext(ctx, `INSERT INTO payment_tokens (id, user_id, token, is_default) VALUES (?, ?, ?, ?)`, ulid.Make().String(), userID, token, isDefault); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func getTestPayment(t *testing.T, rideID string) Payment {
+	t.Helper()
+	payment := Payment{}
+	if err := db.GetContext(context.Background(), &payment, `SELECT * FROM payments WHERE ride_id = ?`, rideID); err != nil {
+		t.Fatal(err)
+	}
+	return payment
+}
+
+// processTestPayment は claimPayments が確保したときと同じように、記録されている決済を attempts 回目として送る
+func processTestPayment(t *testing.T, rideID string, attempts int) Payment {
+	t.Helper()
+	payment := getTestPayment(t, rideID)
+	payment.Attempts = attempts
+	if err := processPayment(context.Background(), &payment); err != nil {
+		t.Fatal(err)
+	}
+	return getTestPayment(t, rideID)
+}
+
+// 結果が分からなかった決済は PENDING のまま残り、次に送ったときに一度だけ請求される
+func TestProcessPaymentRetriesWithoutDoubleCharge(t *testing.T) {
+	setupTestDB(t)
+	mockURL := startPaymentMock(t)
+	usePaymentMock(t, mockURL)
+
+	payment, token := insertTestPayment(t, 1200)
+
+	setPaymentMockFaults(t, mockURL, `{"error_before_record": 1}`)
+	got := processTestPayment(t, payment.RideID, 1)
+	if got.Status != PaymentStatusPending || !got.LastError.Valid {
+		t.Fatalf("after an upstream error: status = %s, last_error = %v, want PENDING with an error", got.Status, got.LastError)
+	}
+	assertCharged(t, mockURL, token)
+
+	// 決済を記録した後にエラーを返されても、リトライは同じ Idempotency-Key なので一度だけ請求される
+	setPaymentMockFaults(t, mockURL, `{"error_after_record": 1}`)
+	got = processTestPayment(t, payment.RideID, 2)
+	if got.Status != PaymentStatusSucceeded || got.Token.String != token {
+		t.Errorf("status = %s, token = %v, want SUCCEEDED with %s", got.Status, got.Token, token)
+	}
+	// 確保が切れて送り直されても請求は増えない
+	setPaymentMockFaults(t, mockURL, `{}`)
+	processTestPayment(t, payment.RideID, 3)
+	assertCharged(t, mockURL, token, 1200)
+}
+
+// 結果が分からなかった決済は、その間に既定の決済トークンが変わって前の決済トークンが削除されても前と同じ決済トークンで送り直す
+func TestProcessPaymentKeepsTokenUntilResolved(t *testing.T) {
+	setupTestDB(t)
+	mockURL := startPaymentMock(t)
+	usePaymentMock(t, mockURL)
+	ctx := context.Background()
+
+	payment, token := insertTestPayment(t, 1500)
+
+	// 決済を記録した後に結果を受け取れなかった状態にする
+	if _, err := db.ExecContext(ctx, `UPDATE payments SET token = ?, last_error = 'timeout' WHERE ride_id = ?`, token, payment.RideID); err != nil {
+		t.Fatal(err)
+	}
+	if err := paymentGateway.PostPayment(ctx, mockURL, token, payment.RideID, &paymentGatewayPostPaymentRequest{Amount: payment.Amount}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM payment_tokens WHERE user_id = ?`, payment.UserID); err != nil {
+		t.Fatal(err)
+	}
+	newToken := addTestPaymentToken(t, payment.UserID, true)
+	if got := processTestPayment(t, payment.RideID, 2); got.Status != PaymentStatusSucceeded || got.Token.String != token {
+		t.Errorf("status = %s, token = %v, want SUCCEEDED with %s", got.Status, got.Token, token)
+	}
+	assertCharged(t, mockURL, token, 1500)
+	assertCharged(t, mockURL, newToken)
+}
+
+// 既定の決済トークンが拒否された場合だけ、次の決済トークンで決済する
+func TestProcessPaymentFallsBackOnRejection(t *testing.T) {
+	setupTestDB(t)
+	mockURL := startPaymentMock(t)
+	usePaymentMock(t, mockURL)
+	ctx := context.Background()
+
+	payment, token := insertTestPayment(t, 1200)
+	backup := addTestPaymentToken(t, payment.UserID, false)
+
+	// 同じキーで異なる額の決済を済ませておき、既定の決済トークンでの決済を拒否させる
+	if err := paymentGateway.PostPayment(ctx, mockURL, token, payment.RideID, &paymentGatewayPostPaymentRequest{Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := processTestPayment(t, payment.RideID, 1); got.Status != PaymentStatusSucceeded || got.Token.String != backup {
+		t.Errorf("status = %s, token = %v, want SUCCEEDED with %s", got.Status, got.Token, backup)
+	}
+	assertCharged(t, mockURL, token, 1)
+	assertCharged(t, mockURL, backup, 1200)
+}
+
+// 既定の決済トークンで結果が分からなかった場合は次の決済トークンを試さず、分かるまで同じ決済トークンで送り直す
+func TestProcessPaymentDoesNotFallBackOnUnknownOutcome(t *testing.T) {
+	setupTestDB(t)
+	mockURL := startPaymentMock(t)
+	usePaymentMock(t, mockURL)
+
+	payment, token := insertTestPayment(t, 1200)
+	backup := addTestPaymentToken(t, payment.UserID, false)
+
+	setPaymentMockFaults(t, mockURL, `{"error_before_record": 1}`)
+	if got := processTestPayment(t, payment.RideID, 1); got.Status != PaymentStatusPending || got.Token.String != token {
+		t.Fatalf("status = %s, token = %v, want PENDING with %s", got.Status, got.Token, token)
+	}
+	assertCharged(t, mockURL, backup)
+
+	setPaymentMockFaults(t, mockURL, `{}`)
+	if got := processTestPayment(t, payment.RideID, 2); got.Status != PaymentStatusSucceeded || got.Token.String != token {
+		t.Errorf("status = %s, token = %v, want SUCCEEDED with %s", got.Status, got.Token, token)
+	}
+	assertCharged(t, mockURL, token, 1200)
+	assertCharged(t, mockURL, backup)
+}
+
+// 決済トークンが登録されていない決済はリトライせずに PAYMENT_FAILED になる
+func TestProcessPaymentWithoutToken(t *testing.T) {
+	setupTestDB(t)
+	mockURL := startPaymentMock(t)
+	usePaymentMock(t, mockURL)
+	ctx := context.Background()
+
+	payment, token := insertTestPayment(t, 800)
+	if _, err := db.ExecContext(ctx, `DELETE FROM payment_tokens WHERE user_id = ?`, payment.UserID); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := processTestPayment(t, payment.RideID, 1); got.Status != PaymentStatusFailed || got.Token.Valid {
+		t.Errorf("status = %s, token = %v, want %s without a token", got.Status, got.Token, PaymentStatusFailed)
+	}
+	assertCharged(t, mockURL, token)
+}
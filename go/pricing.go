@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// CouponDiscountTypeAmount のクーポンは discount 円を割り引く
+	CouponDiscountTypeAmount = "AMOUNT"
+	// CouponDiscountTypePercent のクーポンは discount % を割り引く
+	CouponDiscountTypePercent = "PERCENT"
+
+	// CouponAppliesToMetered のクーポンは距離に応じた運賃だけを割り引き、初乗り運賃は割り引かない
+	CouponAppliesToMetered = "METERED"
+	// CouponAppliesToTotal のクーポンは初乗り運賃を含めた運賃を割り引く
+	CouponAppliesToTotal = "TOTAL"
+)
+
+// 運賃の計算は全て calculatePrice で行う
+// 見積もり、ライドの作成、履歴、決済、照合で同じ額になるよう、これ以外の場所で運賃を計算しないこと
+
+// calculatePrice はライドの運賃を返す。coupon が nil の場合は割り引かない
+func calculatePrice(pickupLatitude, pickupLongitude, destLatitude, destLongitude int, coupon *Coupon) int {
+	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+	return initialFare + meteredFare - couponDiscount(coupon, initialFare, meteredFare)
+}
+
+// couponDiscount はクーポンの割引額を返す。割引額は割引の対象の運賃を超えない
+func couponDiscount(coupon *Coupon, baseFare, meteredFare int) int {
+	if coupon == nil || !couponApplicable(coupon, baseFare+meteredFare) {
+		return 0
+	}
+
+	target := meteredFare
+	if coupon.AppliesTo == CouponAppliesToTotal {
+		target = baseFare + meteredFare
+	}
+
+	discount := coupon.Discount
+	if coupon.DiscountType == CouponDiscountTypePercent {
+		discount = target * coupon.Discount / 100
+	}
+	if coupon.MaxDiscount.Valid {
+		discount = min(discount, int(coupon.MaxDiscount.Int64))
+	}
+	return max(min(discount, target), 0)
+}
+
+// couponApplicable は割引前の運賃が fare のライドにクーポンを使えるかを返す
+func couponApplicable(coupon *Coupon, fare int) bool {
+	return !coupon.MinFare.Valid || int64(fare) >= coupon.MinFare.Int64
+}
+
+// calculateFare は割引前の運賃を返す
+func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
+	return calculatePrice(pickupLatitude, pickupLongitude, destLatitude, destLongitude, nil)
+}
+
+// calculateDiscountedFare はクーポンを適用した運賃を返す
+// ride を指定した場合はそのライドに使われたクーポンを、指定しない場合は次のライドで使われるクーポンを適用する
+func calculateDiscountedFare(ctx context.Context, q sqlx.QueryerContext, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
+	var coupon *Coupon
+	if ride != nil {
+		destLatitude = ride.DestinationLatitude
+		destLongitude = ride.DestinationLongitude
+		pickupLatitude = ride.PickupLatitude
+		pickupLongitude = ride.PickupLongitude
+
+		// すでにクーポンが紐づいているならそれを適用
+		c := &Coupon{}
+		if err := sqlx.GetContext(ctx, q, c, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return 0, err
+			}
+		} else {
+			coupon = c
+		}
+	} else {
+		// 次のライドで使われるクーポンを適用
+		rideCount := 0
+		if err := sqlx.GetContext(ctx, q, &rideCount, "SELECT COUNT(*) FROM rides WHERE user_id = ?", userID); err != nil {
+			return 0, err
+		}
+		c, err := findUsableCoupon(ctx, q, userID, rideCount == 0, calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude), false)
+		if err != nil {
+			return 0, err
+		}
+		coupon = c
+	}
+
+	return calculatePrice(pickupLatitude, pickupLongitude, destLatitude, destLongitude, coupon), nil
+}
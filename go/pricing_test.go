@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestCalculatePrice(t *testing.T) {
+	amount := func(discount int, appliesTo string) *Coupon {
+		return &Coupon{Discount: discount, DiscountType: CouponDiscountTypeAmount, AppliesTo: appliesTo}
+	}
+	percent := func(discount int, appliesTo string) *Coupon {
+		return &Coupon{Discount: discount, DiscountType: CouponDiscountTypePercent, AppliesTo: appliesTo}
+	}
+	withMaxDiscount := func(c *Coupon, maxDiscount int64) *Coupon {
+		c.MaxDiscount = sql.NullInt64{Int64: maxDiscount, Valid: true}
+		return c
+	}
+	withMinFare := func(c *Coupon, minFare int64) *Coupon {
+		c.MinFare = sql.NullInt64{Int64: minFare, Valid: true}
+		return c
+	}
+
+	// 距離 10 のライドは初乗り運賃 500 + 距離に応じた運賃 1000 = 1500
+	tests := []struct {
+		name     string
+		distance int
+		coupon   *Coupon
+		want     int
+	}{
+		{name: "no coupon", distance: 10, coupon: nil, want: 1500},
+		{name: "amount off metered", distance: 10, coupon: amount(300, CouponAppliesToMetered), want: 1200},
+		{name: "amount off metered does not discount the base fare", distance: 10, coupon: amount(3000, CouponAppliesToMetered), want: 500},
+		{name: "amount off total", distance: 10, coupon: amount(3000, CouponAppliesToTotal), want: 0},
+		{name: "amount with max discount", distance: 10, coupon: withMaxDiscount(amount(300, CouponAppliesToMetered), 200), want: 1300},
+		{name: "percent off metered", distance: 10, coupon: percent(10, CouponAppliesToMetered), want: 1400},
+		{name: "percent off total", distance: 10, coupon: percent(10, CouponAppliesToTotal), want: 1350},
+		{name: "percent rounds the discount down", distance: 10, coupon: percent(33, CouponAppliesToMetered), want: 1170},
+		{name: "percent with max discount", distance: 10, coupon: withMaxDiscount(percent(50, CouponAppliesToTotal), 500), want: 1000},
+		{name: "percent under max discount", distance: 10, coupon: withMaxDiscount(percent(10, CouponAppliesToTotal), 500), want: 1350},
+		{name: "full percent off total", distance: 10, coupon: percent(100, CouponAppliesToTotal), want: 0},
+		{name: "below min fare", distance: 10, coupon: withMinFare(amount(300, CouponAppliesToMetered), 1501), want: 1500},
+		{name: "at min fare", distance: 10, coupon: withMinFare(amount(300, CouponAppliesToMetered), 1500), want: 1200},
+		{name: "min fare compares the fare including the base fare", distance: 0, coupon: withMinFare(amount(300, CouponAppliesToTotal), 500), want: 200},
+		{name: "no distance, metered", distance: 0, coupon: percent(50, CouponAppliesToMetered), want: 500},
+		{name: "no distance, total", distance: 0, coupon: percent(50, CouponAppliesToTotal), want: 250},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := calculatePrice(0, 0, tt.distance, 0, tt.coupon); got != tt.want {
+				t.Errorf("calculatePrice() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalculateFare(t *testing.T) {
+	if got, want := calculateFare(3, 4, -2, 8), initialFare+farePerDistance*9; got != want {
+		t.Errorf("calculateFare() = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+)
+
+// 照合は利用者ごとに、利用者の決済トークンの社内決済マイクロサービスの決済の一覧と、利用者に請求すべきもの
+// (完了したライドの割引後の運賃とキャンセル料)を突き合わせる
+// 決済はライドIDを Idempotency-Key として送っているので、キーで対応をとる。キーのない決済は決済額で対応をとる
+
+type reconcileOptions struct {
+	// Since 以降に完了またはキャンセルされたライドだけを照合する
+	Since time.Time
+	// RetryMissing が true の場合、請求されていないライドの決済を積み直す
+	RetryMissing bool
+}
+
+type reconcileReport struct {
+	Users      int                  `json:"users"`
+	Charges    int                  `json:"charges"`
+	Matched    int                  `json:"matched"`
+	Pending    int                  `json:"pending"`
+	Missing    []reconcileMissing   `json:"missing"`
+	Duplicates []reconcileCharge    `json:"duplicates"`
+	Mismatched []reconcileMismatch  `json:"mismatched"`
+	Unexpected []reconcileCharge    `json:"unexpected"`
+	Errors     []reconcileUserError `json:"errors"`
+}
+
+// reconcileMissing は請求されていないライド。PaymentStatus は payments の状態で、決済が積まれていない場合は空
+type reconcileMissing struct {
+	UserID        string `json:"user_id"`
+	RideID        string `json:"ride_id"`
+	Amount        int    `json:"amount"`
+	PaymentStatus string `json:"payment_status,omitempty"`
+	Retried       bool   `json:"retried"`
+}
+
+// reconcileMismatch は請求すべき額とは異なる額で請求されたライド
+type reconcileMismatch struct {
+	UserID         string `json:"user_id"`
+	RideID         string `json:"ride_id"`
+	ExpectedAmount int    `json:"expected_amount"`
+	ChargedAmount  int    `json:"charged_amount"`
+}
+
+// reconcileCharge はどのライドにも対応しない請求
+// 同じ額のライドがある場合は二重請求(Duplicates)、ない場合は身に覚えのない請求(Unexpected)とする
+type reconcileCharge struct {
+	UserID string `json:"user_id"`
+	Amount int    `json:"amount"`
+}
+
+type reconcileUserError struct {
+	UserID string `json:"user_id"`
+	Error  string `json:"error"`
+}
+
+// expectedCharge は利用者に請求されているべきもの
+type expectedCharge struct {
+	RideID  string
+	Amount  int
+	Payment *Payment
+}
+
+// reconcilePayments は決済トークンを登録している全ての利用者を照合する
+func reconcilePayments(ctx context.Context, opts reconcileOptions) (*reconcileReport, error) {
+	tokens := []PaymentToken{}
+	if err := db.SelectContext(ctx, &tokens, `SELECT * FROM payment_tokens ORDER BY user_id, created_at`); err != nil {
+		return nil, err
+	}
+	userIDs := []string{}
+	tokensByUserID := map[string][]string{}
+	for _, token := range tokens {
+		if _, ok := tokensByUserID[token.UserID]; !ok {
+			userIDs = append(userIDs, token.UserID)
+		}
+		tokensByUserID[token.UserID] = append(tokensByUserID[token.UserID], token.Token)
+	}
+
+	report := &reconcileReport{
+		Missing:    []reconcileMissing{},
+		Duplicates: []reconcileCharge{},
+		Mismatched: []reconcileMismatch{},
+		Unexpected: []reconcileCharge{},
+		Errors:     []reconcileUserError{},
+	}
+	for _, userID := range userIDs {
+		if err := reconcileUser(ctx, userID, tokensByUserID[userID], opts, report); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// 社内決済マイクロサービスのエラーなどは他の利用者の照合を止めずに報告する
+			report.Errors = append(report.Errors, reconcileUserError{UserID: userID, Error: err.Error()})
+			continue
+		}
+		report.Users++
+	}
+	if opts.RetryMissing && len(report.Missing) > 0 {
+		paymentQueue.Trigger()
+	}
+	return report, nil
+}
+
+// reconcileUser は利用者の決済トークンと、過去に決済を送った決済トークンの全ての決済をまとめて照合する
+func reconcileUser(ctx context.Context, userID string, tokens []string, opts reconcileOptions, report *reconcileReport) error {
+	expected, err := getExpectedCharges(ctx, userID, opts.Since)
+	if err != nil {
+		return err
+	}
+	for _, e := range expected {
+		if e.Payment != nil && e.Payment.Token.Valid && !slices.Contains(tokens, e.Payment.Token.String) {
+			tokens = append(tokens, e.Payment.Token.String)
+		}
+	}
+
+	// ライドIDを Idempotency-Key として請求された額。Idempotency-Key は決済トークンごとなので、複数の額があれば二重請求
+	chargedByKey := map[string][]int{}
+	// Idempotency-Key のない決済の額ごとの請求回数
+	remaining := map[int]int{}
+	for _, token := range tokens {
+		charges, err := paymentGateway.GetPayments(ctx, paymentGatewayURL, token)
+		if err != nil {
+			return err
+		}
+		report.Charges += len(charges)
+		for _, c := range charges {
+			if c.IdempotencyKey != "" {
+				chargedByKey[c.IdempotencyKey] = append(chargedByKey[c.IdempotencyKey], c.Amount)
+			} else {
+				remaining[c.Amount]++
+			}
+		}
+	}
+
+	expectedAmounts := map[int]bool{}
+	for _, e := range expected {
+		expectedAmounts[e.Amount] = true
+	}
+
+	// ライドIDで請求されているライドを先に対応づけ、残りは請求すべき額で対応づける
+	unmatched := []expectedCharge{}
+	for _, e := range expected {
+		if amounts, ok := chargedByKey[e.RideID]; ok {
+			delete(chargedByKey, e.RideID)
+			if amounts[0] == e.Amount {
+				report.Matched++
+			} else {
+				report.Mismatched = append(report.Mismatched, reconcileMismatch{
+					UserID:         userID,
+					RideID:         e.RideID,
+					ExpectedAmount: e.Amount,
+					ChargedAmount:  amounts[0],
+				})
+			}
+			for _, amount := range amounts[1:] {
+				report.Duplicates = append(report.Duplicates, reconcileCharge{UserID: userID, Amount: amount})
+			}
+			continue
+		}
+		if remaining[e.Amount] > 0 {
+			remaining[e.Amount]--
+			report.Matched++
+			continue
+		}
+		unmatched = append(unmatched, e)
+	}
+	// 照合の範囲外のライドの決済は、キーのない決済と同じく額で扱う
+	for _, amounts := range chargedByKey {
+		for _, amount := range amounts {
+			remaining[amount]++
+		}
+	}
+
+	for _, e := range unmatched {
+		// 決済が積まれた時点の額で請求されていれば、額の食い違いとする
+		if e.Payment != nil && e.Payment.Amount != e.Amount && remaining[e.Payment.Amount] > 0 {
+			remaining[e.Payment.Amount]--
+			report.Mismatched = append(report.Mismatched, reconcileMismatch{
+				UserID:         userID,
+				RideID:         e.RideID,
+				ExpectedAmount: e.Amount,
+				ChargedAmount:  e.Payment.Amount,
+			})
+			continue
+		}
+		// 送っている最中の決済はまだ請求されていなくてもよい
+		if e.Payment != nil && e.Payment.Status == PaymentStatusPending {
+			report.Pending++
+			continue
+		}
+
+		// ここまで来たライドは、利用者のどの決済トークンでもライドIDで請求されていない
+		missing := reconcileMissing{
+			UserID: userID,
+			RideID: e.RideID,
+			Amount: e.Amount,
+		}
+		if e.Payment != nil {
+			missing.PaymentStatus = e.Payment.Status
+		}
+		if opts.RetryMissing {
+			if err := requeuePayment(ctx, userID, e); err != nil {
+				return err
+			}
+			missing.Retried = true
+		}
+		report.Missing = append(report.Missing, missing)
+	}
+
+	for _, amount := range slices.Sorted(maps.Keys(remaining)) {
+		for range remaining[amount] {
+			c := reconcileCharge{UserID: userID, Amount: amount}
+			if expectedAmounts[amount] {
+				report.Duplicates = append(report.Duplicates, c)
+			} else {
+				report.Unexpected = append(report.Unexpected, c)
+			}
+		}
+	}
+	return nil
+}
+
+// getExpectedCharges は利用者の完了したライドの割引後の運賃と、キャンセル料がかかったライドのキャンセル料を返す
+func getExpectedCharges(ctx context.Context, userID string, since time.Time) ([]expectedCharge, error) {
+	payments := []Payment{}
+	if err := db.SelectContext(ctx, &payments, `SELECT * FROM payments WHERE user_id = ?`, userID); err != nil {
+		return nil, err
+	}
+	paymentByRideID := make(map[string]*Payment, len(payments))
+	for i := range payments {
+		paymentByRideID[payments[i].RideID] = &payments[i]
+	}
+
+	rides := []Ride{}
+	if err := db.SelectContext(ctx, &rides, `
+		SELECT rides.*
+		FROM rides
+		JOIN ride_statuses ON ride_statuses.ride_id = rides.id
+		WHERE rides.user_id = ? AND ride_statuses.status = 'COMPLETED' AND rides.updated_at >= ?
+		ORDER BY rides.updated_at`, userID, since); err != nil {
+		return nil, err
+	}
+
+	expected := make([]expectedCharge, 0, len(rides))
+	for _, ride := range rides {
+		fare, err := calculateDiscountedFare(ctx, db, userID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+		if err != nil {
+			return nil, err
+		}
+		expected = append(expected, expectedCharge{RideID: ride.ID, Amount: fare, Payment: paymentByRideID[ride.ID]})
+	}
+
+	cancellations := []RideCancellation{}
+	if err := db.SelectContext(ctx, &cancellations, `
+		SELECT ride_cancellations.*
+		FROM ride_cancellations
+		JOIN rides ON rides.id = ride_cancellations.ride_id
+		WHERE rides.user_id = ? AND ride_cancellations.fee > 0 AND ride_cancellations.created_at >= ?
+		ORDER BY ride_cancellations.created_at`, userID, since); err != nil {
+		return nil, err
+	}
+	for _, c := range cancellations {
+		expected = append(expected, expectedCharge{RideID: c.RideID, Amount: c.Fee, Payment: paymentByRideID[c.RideID]})
+	}
+
+	return expected, nil
+}
+
+// requeuePayment は請求されていないライドの決済を積み直す
+// Idempotency-Key は決済トークンごとなので、別の決済トークンで請求済みのライドを積み直すと二重に請求してしまう
+// 利用者の全ての決済トークンの決済にライドIDがないことを確かめてから呼ぶこと
+func requeuePayment(ctx context.Context, userID string, e expectedCharge) error {
+	if e.Payment == nil {
+		_, err := db.ExecContext(ctx,
+			`INSERT INTO payments (ride_id, user_id, amount, status) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE ride_id = ride_id`,
+			e.RideID, userID, e.Amount, PaymentStatusPending,
+		)
+		return err
+	}
+	_, err := db.ExecContext(ctx,
+		`UPDATE payments SET status = ?, attempts = 0, next_attempt_at = NOW(6) WHERE ride_id = ? AND status != ?`,
+		PaymentStatusPending, e.RideID, PaymentStatusPending,
+	)
+	return err
+}
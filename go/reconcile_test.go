@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// insertTestCompletedRide は原点から (destLatitude, destLongitude) まで移動して完了したライドを作る
+func insertTestCompletedRide(t *testing.T, userID string, destLatitude, destLongitude int) string {
+	t.Helper()
+	ctx := context.Background()
+
+	rideID := ulid.Make().String()
+	if _, err := db.ExecContext(ctx, `INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude) VALUES (?, ?, 0, 0, ?, ?)`, rideID, userID, destLatitude, destLongitude); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, `INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, 'COMPLETED')`, ulid.Make().String(), rideID); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.ExecContext(ctx, `DELETE FROM ride_statuses WHERE ride_id = ?`, rideID)
+		db.ExecContext(ctx, `DELETE FROM rides WHERE id = ?`, rideID)
+		db.ExecContext(ctx, `DELETE FROM payments WHERE ride_id = ?`, rideID)
+	})
+	return rideID
+}
+
+// 決済トークンを登録し直す前の決済トークンで請求されたライドは積み直さず、どこでも請求されていないライドだけを積み直す
+func TestReconcileUserRequeuesOnlyUnchargedRides(t *testing.T) {
+	setupTestDB(t)
+	mockURL := startPaymentMock(t)
+	usePaymentMock(t, mockURL)
+	ctx := context.Background()
+
+	userID := ulid.Make().String()
+	oldToken, newToken := ulid.Make().String(), ulid.Make().String()
+	if _, err := db.ExecContext(ctx, `INSERT INTO payment_tokens (id, user_id, token, is_default) VALUES (?, ?, ?, 1)`, ulid.Make().String(), userID, newToken); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.ExecContext(ctx, `DELETE FROM payment_tokens WHERE user_id = ?`, userID)
+	})
+
+	charged := insertTestCompletedRide(t, userID, 4, 6)
+	if _, err := db.ExecContext(ctx, `INSERT INTO payments (ride_id, user_id, amount, status, token) VALUES (?, ?, 1500, ?, ?)`, charged, userID, PaymentStatusSucceeded, oldToken); err != nil {
+		t.Fatal(err)
+	}
+	if err := paymentGateway.PostPayment(ctx, mockURL, oldToken, charged, &paymentGatewayPostPaymentRequest{Amount: 1500}); err != nil {
+		t.Fatal(err)
+	}
+	uncharged := insertTestCompletedRide(t, userID, 1, 0)
+	if _, err := db.ExecContext(ctx, `INSERT INTO payments (ride_id, user_id, amount, status) VALUES (?, ?, 600, ?)`, uncharged, userID, PaymentStatusFailed); err != nil {
+		t.Fatal(err)
+	}
+
+	report := &reconcileReport{}
+	if err := reconcileUser(ctx, userID, []string{newToken}, reconcileOptions{Since: time.Unix(0, 0), RetryMissing: true}, report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Matched != 1 || len(report.Missing) != 1 || report.Missing[0].RideID != uncharged || !report.Missing[0].Retried {
+		t.Fatalf("matched = %d, missing = %+v, want only %s missing and retried", report.Matched, report.Missing, uncharged)
+	}
+	if len(report.Duplicates) != 0 || len(report.Unexpected) != 0 || len(report.Mismatched) != 0 {
+		t.Errorf("duplicates = %v, unexpected = %v, mismatched = %v, want none", report.Duplicates, report.Unexpected, report.Mismatched)
+	}
+	if got := getTestPayment(t, charged); got.Status != PaymentStatusSucceeded {
+		t.Errorf("charged ride: status = %s, want %s", got.Status, PaymentStatusSucceeded)
+	}
+	if got := getTestPayment(t, uncharged); got.Status != PaymentStatusPending {
+		t.Errorf("uncharged ride: status = %s, want %s", got.Status, PaymentStatusPending)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	RefundStatusPending   = "PENDING"
+	RefundStatusSucceeded = "SUCCEEDED"
+	RefundStatusFailed    = "FAILED"
+
+	RefundRequestedByOwner = "OWNER"
+	RefundRequestedByAdmin = "ADMIN"
+)
+
+var (
+	errRideNotCharged       = errors.New("ride has not been charged")
+	errRefundExceedsPayment = errors.New("refund amount exceeds the refundable amount")
+)
+
+// 返金は決済(payments)に対して行い、返金IDを Idempotency-Key として社内決済マイクロサービスに送る
+// 返金の合計は決済額を超えられない。拒否された(FAILED)返金は合計に数えない
+// 結果が分からなかった返金は返金されている可能性があるので PENDING のまま合計に数え、paymentQueue が同じ返金IDで送り直す
+
+// refundRide はライドの決済から amount を返金する。amount が nil の場合はまだ返金していない全額を返金する
+// 返金を記録してから送るので、社内決済マイクロサービスの呼び出しに失敗した場合も返金は残る
+func refundRide(ctx context.Context, rideID string, amount *int, reason string, requestedBy string) (*Refund, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// 同じ決済への返金が同時に行われても決済額を超えないよう、決済をロックしてから返金済みの額を数える
+	payment := &Payment{}
+	if err := tx.GetContext(ctx, payment, `SELECT * FROM payments WHERE ride_id = ? FOR UPDATE`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errRideNotCharged
+		}
+		return nil, err
+	}
+	if payment.Status != PaymentStatusSucceeded || !payment.Token.Valid {
+		return nil, errRideNotCharged
+	}
+
+	refunded := 0
+	if err := tx.GetContext(ctx, &refunded, `SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE ride_id = ? AND status != ?`, rideID, RefundStatusFailed); err != nil {
+		return nil, err
+	}
+	refundable := payment.Amount - refunded
+	refundAmount := refundable
+	if amount != nil {
+		refundAmount = *amount
+	}
+	if refundAmount <= 0 || refundAmount > refundable {
+		return nil, fmt.Errorf("%w (refundable: %d)", errRefundExceedsPayment, refundable)
+	}
+
+	// この場で送るので、paymentQueue が同時に送らないよう確保した状態で登録する
+	refund := &Refund{
+		ID:          ulid.Make().String(),
+		RideID:      rideID,
+		Amount:      refundAmount,
+		Reason:      reason,
+		RequestedBy: requestedBy,
+		Status:      RefundStatusPending,
+		Attempts:    1,
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO refunds (id, ride_id, amount, reason, requested_by, status, attempts, next_attempt_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		refund.ID, refund.RideID, refund.Amount, refund.Reason, refund.RequestedBy, refund.Status, refund.Attempts, time.Now().Add(paymentClaimDuration),
+	); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// リクエストが切断されても PENDING のまま残らないよう、返金の結果は最後まで記録する
+	ctx = context.WithoutCancel(ctx)
+	sendErr := paymentGateway.PostRefund(ctx, paymentGatewayURL, payment.Token.String, payment.RideID, refund.ID, &paymentGatewayPostRefundRequest{Amount: refund.Amount})
+	if err := recordRefundAttempt(ctx, refund, sendErr); err != nil {
+		return nil, err
+	}
+	if err := db.GetContext(ctx, refund, `SELECT * FROM refunds WHERE id = ?`, refund.ID); err != nil {
+		return nil, err
+	}
+	if sendErr != nil {
+		return refund, sendErr
+	}
+	return refund, nil
+}
+
+type refundTarget struct {
+	Refund
+	Token string `db:"token"`
+}
+
+// claimRefunds は送り直す時刻を迎えた返金を確保する。決済と同じく next_attempt_at を先に進めて確保する
+func claimRefunds(ctx context.Context) ([]refundTarget, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	targets := []refundTarget{}
+	if err := tx.SelectContext(ctx, &targets, `
+		SELECT refunds.*, payments.token
+		FROM refunds
+		         INNER JOIN payments ON payments.ride_id = refunds.ride_id
+		WHERE refunds.status = ?
+		  AND refunds.next_attempt_at <= NOW(6)
+		ORDER BY refunds.next_attempt_at
+		LIMIT ?
+		FOR UPDATE OF refunds SKIP LOCKED`, RefundStatusPending, paymentBatchSize); err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, 0, len(targets))
+	for _, t := range targets {
+		ids = append(ids, t.ID)
+	}
+	query, args, err := sqlx.In(`UPDATE refunds SET attempts = attempts + 1, next_attempt_at = ? WHERE id IN (?)`, time.Now().Add(paymentClaimDuration), ids)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for i := range targets {
+		targets[i].Attempts++
+	}
+	return targets, nil
+}
+
+// processRefund は確保した返金を同じ返金IDで送り直し、結果を記録する
+func processRefund(ctx context.Context, t *refundTarget) error {
+	sendErr := paymentGateway.PostRefund(ctx, paymentGatewayURL, t.Token, t.RideID, t.ID, &paymentGatewayPostRefundRequest{Amount: t.Amount})
+	if ctx.Err() != nil {
+		// 停止中に送ったものは確保が切れた後に送り直す
+		return nil
+	}
+	return recordRefundAttempt(ctx, &t.Refund, sendErr)
+}
+
+// recordRefundAttempt は返金を送った結果を記録する
+// 拒否された場合だけ FAILED とし、結果が分からなかった場合は PENDING のまま送り直す時刻を決める
+func recordRefundAttempt(ctx context.Context, refund *Refund, sendErr error) error {
+	if sendErr == nil {
+		refund.Status = RefundStatusSucceeded
+		_, err := db.ExecContext(ctx, `UPDATE refunds SET status = ?, last_error = NULL WHERE id = ?`, refund.Status, refund.ID)
+		return err
+	}
+
+	refund.LastError = sql.NullString{String: sendErr.Error(), Valid: true}
+	if errors.Is(sendErr, errPaymentRejected) {
+		slog.Warn("refund rejected", slog.String("refund_id", refund.ID), slog.String("ride_id", refund.RideID), slog.Any("err", sendErr))
+		refund.Status = RefundStatusFailed
+		_, err := db.ExecContext(ctx, `UPDATE refunds SET status = ?, last_error = ? WHERE id = ?`, refund.Status, refund.LastError, refund.ID)
+		return err
+	}
+
+	// サーキットブレーカーが開いている間は送っていないので、試行回数に数えずに閉じるのを待つ
+	if errors.Is(sendErr, errPaymentCircuitOpen) {
+		_, err := db.ExecContext(ctx, `UPDATE refunds SET attempts = attempts - 1, next_attempt_at = ?, last_error = ? WHERE id = ?`, time.Now().Add(paymentGatewayOpenDuration), refund.LastError, refund.ID)
+		return err
+	}
+
+	_, err := db.ExecContext(ctx, `UPDATE refunds SET next_attempt_at = ?, last_error = ? WHERE id = ?`, time.Now().Add(paymentBackoff(refund.Attempts)), refund.LastError, refund.ID)
+	return err
+}
+
+// getRefundedAmounts は ownerID の椅子のライドごとの返金済みの額を返す
+// 結果が分からない返金も返金されている可能性があるので含める
+func getRefundedAmounts(ctx context.Context, tx *sqlx.Tx, ownerID string) (map[string]int, error) {
+	rows := []struct {
+		RideID string `db:"ride_id"`
+		Amount int    `db:"amount"`
+	}{}
+	if err := tx.SelectContext(ctx, &rows, `
+		SELECT refunds.ride_id, SUM(refunds.amount) AS amount
+		FROM refunds
+		JOIN rides ON rides.id = refunds.ride_id
+		JOIN chairs ON chairs.id = rides.chair_id
+		WHERE chairs.owner_id = ? AND refunds.status != ?
+		GROUP BY refunds.ride_id`, ownerID, RefundStatusFailed); err != nil {
+		return nil, err
+	}
+	refunded := make(map[string]int, len(rows))
+	for _, row := range rows {
+		refunded[row.RideID] = row.Amount
+	}
+	return refunded, nil
+}
+
+type refundResponse struct {
+	ID          string `json:"id"`
+	RideID      string `json:"ride_id"`
+	Amount      int    `json:"amount"`
+	Reason      string `json:"reason"`
+	RequestedBy string `json:"requested_by"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+func newRefundResponse(refund *Refund) refundResponse {
+	return refundResponse{
+		ID:          refund.ID,
+		RideID:      refund.RideID,
+		Amount:      refund.Amount,
+		Reason:      refund.Reason,
+		RequestedBy: refund.RequestedBy,
+		Status:      refund.Status,
+		Error:       refund.LastError.String,
+		CreatedAt:   refund.CreatedAt.UnixMilli(),
+	}
+}
+
+type postRefundRequest struct {
+	// 省略した場合はまだ返金していない全額を返金する
+	Amount *int   `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+// writeRefund は返金を行い結果を返す。オーナーと管理者の返金APIで共通
+func writeRefund(w http.ResponseWriter, r *http.Request, rideID string, requestedBy string) {
+	req := &postRefundRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Reason == "" {
+		writeError(w, http.StatusBadRequest, errors.New("required fields(reason) are empty"))
+		return
+	}
+	if req.Amount != nil && *req.Amount <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("amount must be positive"))
+		return
+	}
+
+	refund, err := refundRide(r.Context(), rideID, req.Amount, req.Reason, requestedBy)
+	if err != nil {
+		switch {
+		case errors.Is(err, errRideNotCharged), errors.Is(err, errRefundExceedsPayment):
+			writeError(w, http.StatusBadRequest, err)
+		case refund != nil && errors.Is(err, errPaymentRejected):
+			writeJSON(w, http.StatusBadRequest, newRefundResponse(refund))
+		case refund != nil && errors.Is(err, erroredUpstream):
+			// 結果が分からないので PENDING のまま送り直す
+			writeJSON(w, http.StatusAccepted, newRefundResponse(refund))
+		default:
+			writeError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newRefundResponse(refund))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// RideState はライドの状態。ride_statuses.status に記録される
+type RideState string
+
+const (
+	RideStateMatching  RideState = "MATCHING"
+	RideStateEnroute   RideState = "ENROUTE"
+	RideStatePickup    RideState = "PICKUP"
+	RideStateCarrying  RideState = "CARRYING"
+	RideStateArrived   RideState = "ARRIVED"
+	RideStateCompleted RideState = "COMPLETED"
+	RideStateCanceled  RideState = "CANCELED"
+)
+
+// rideStateTransitions は各状態から遷移できる状態の一覧
+// 状態がまだないライド("")は MATCHING にしか遷移できない
+var rideStateTransitions = map[RideState][]RideState{
+	"":                 {RideStateMatching},
+	RideStateMatching:  {RideStateMatching, RideStateEnroute, RideStateCanceled}, // MATCHING -> MATCHING は椅子に辞退されて割り当てをやり直す場合
+	RideStateEnroute:   {RideStatePickup, RideStateCanceled},
+	RideStatePickup:    {RideStateCarrying, RideStateCanceled},
+	RideStateCarrying:  {RideStateArrived},
+	RideStateArrived:   {RideStateCompleted},
+	RideStateCompleted: {},
+	RideStateCanceled:  {},
+}
+
+// Finished は完了またはキャンセルされ、これ以上遷移しない状態かどうか
+func (s RideState) Finished() bool {
+	return s == RideStateCompleted || s == RideStateCanceled
+}
+
+func (s RideState) CanTransitionTo(to RideState) bool {
+	return slices.Contains(rideStateTransitions[s], to)
+}
+
+var ErrRideFinished = errors.New("ride has already finished")
+
+// InvalidRideTransitionError は許可されていない状態遷移を要求されたことを表す
+type InvalidRideTransitionError struct {
+	From RideState
+	To   RideState
+}
+
+func (e *InvalidRideTransitionError) Error() string {
+	if e.From == "" {
+		return fmt.Sprintf("ride cannot start with %s status", e.To)
+	}
+	return fmt.Sprintf("ride cannot change status from %s to %s", e.From, e.To)
+}
+
+func (e *InvalidRideTransitionError) Unwrap() error {
+	if e.From.Finished() {
+		return ErrRideFinished
+	}
+	return nil
+}
+
+// 状態遷移のエラーをレスポンスのステータスコードに対応させる
+// 既に終わったライドへの操作は 409、それ以外の不正な遷移は 400 とする
+func rideStateErrorStatusCode(err error) int {
+	if errors.Is(err, ErrRideFinished) {
+		return http.StatusConflict
+	}
+	var transitionErr *InvalidRideTransitionError
+	if errors.As(err, &transitionErr) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// rideTx はライドの状態遷移を記録するトランザクション
+// 遷移はコミットと同時にアウトボックスに書き込まれ、outboxDispatcher から EventBus に通知される
+type rideTx struct {
+	*sqlx.Tx
+	transitions []rideTransition
+	afterCommit []func()
+}
+
+type rideTransition struct {
+	ride     *Ride
+	statusID string
+	to       RideState
+}
+
+func beginRideTx() (*rideTx, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	return &rideTx{Tx: tx}, nil
+}
+
+// TransitionRide はライドの現在の状態から to への遷移を検証し、ride_statuses に記録する
+// 遷移前の状態を返す
+func (tx *rideTx) TransitionRide(ctx context.Context, ride *Ride, to RideState) (RideState, error) {
+	// 同じライドの遷移が並行して最新の状態を読み、どちらも検証を通ってしまわないようにライドの行をロックする
+	lockedID := ""
+	if err := tx.GetContext(ctx, &lockedID, `SELECT id FROM rides WHERE id = ? FOR UPDATE`, ride.ID); err != nil {
+		return "", err
+	}
+
+	from := RideState("")
+	if err := tx.GetContext(ctx, &from, `SELECT status FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1`, ride.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	if !from.CanTransitionTo(to) {
+		return from, &InvalidRideTransitionError{From: from, To: to}
+	}
+
+	statusID := ulid.Make().String()
+	if _, err := tx.ExecContext(ctx, `INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`, statusID, ride.ID, to); err != nil {
+		return from, err
+	}
+
+	tx.transitions = append(tx.transitions, rideTransition{ride: ride, statusID: statusID, to: to})
+	return from, nil
+}
+
+// AfterCommit はコミットに成功した後に f を呼ぶ。登録順に呼ばれる
+func (tx *rideTx) AfterCommit(f func()) {
+	tx.afterCommit = append(tx.afterCommit, f)
+}
+
+// Commit は記録した状態遷移を利用者、椅子とそのオーナー宛てのイベントとしてアウトボックスに書き込んでからコミットする
+// 通知する内容はコミット時点の ride の値になる
+func (tx *rideTx) Commit() error {
+	ctx := context.Background()
+	for _, t := range tx.transitions {
+		ride := *t.ride
+		data := RideStatusEventData{
+			Ride:         ride,
+			UserID:       ride.UserID,
+			Status:       t.to,
+			RideStatusID: t.statusID,
+		}
+		if err := insertRideEvent(ctx, tx.Tx, userTopic(ride.UserID), data); err != nil {
+			return err
+		}
+		if ride.ChairID.Valid {
+			if err := insertChairRideEvent(ctx, tx.Tx, ride.ChairID.String, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Tx.Commit(); err != nil {
+		return err
+	}
+	if len(tx.transitions) > 0 {
+		outbox.Trigger()
+	}
+	tx.transitions = nil
+
+	for _, f := range tx.afterCommit {
+		f()
+	}
+	tx.afterCommit = nil
+
+	return nil
+}
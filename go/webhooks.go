@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// オーナーが登録した URL に椅子とライドのイベントを HTTP で通知する
+// EventBus の owner:* を購読して owner_webhook_deliveries に積み、webhookDispatcher が配送する
+// 失敗した配送は指数バックオフで再送し、webhookMaxAttempts 回失敗したら owner_webhook_dead_letters に移す
+//
+// 受信側は X-Isuride-Signature が次の値と一致することで検証できる
+//
+//	"sha256=" + hex(HMAC-SHA256(secret, X-Isuride-Timestamp + "." + body))
+//
+// 配送先は https に限る。ISUCON_WEBHOOK_ALLOW_HTTP=1 の場合だけ http も受け付ける(受信側を手元で動かして試す場合など)
+// オーナーが指定した URL から内部のサービスに届かないよう、ループバックやプライベートなどのアドレスには接続しない
+
+const (
+	webhookEventRideCompleted = "ride.completed"
+	webhookEventRideEvaluated = "ride.evaluated"
+	webhookEventChairActivity = "chair.activity"
+
+	webhookPollInterval  = time.Second
+	webhookBatchSize     = 50
+	webhookConcurrency   = 8
+	webhookTimeout       = 5 * time.Second
+	webhookMaxAttempts   = 8
+	webhookBaseBackoff   = time.Second
+	webhookMaxBackoff    = 10 * time.Minute
+	webhookClaimDuration = time.Minute
+)
+
+var webhookEventTypes = []string{webhookEventRideCompleted, webhookEventRideEvaluated, webhookEventChairActivity}
+
+var errWebhookAddressNotAllowed = errors.New("webhook destination address is not allowed")
+
+type webhookPayload struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	OwnerID    string `json:"owner_id"`
+	ChairID    string `json:"chair_id"`
+	RideID     string `json:"ride_id,omitempty"`
+	Sale       *int   `json:"sale,omitempty"`
+	Evaluation *int   `json:"evaluation,omitempty"`
+	Active     *bool  `json:"active,omitempty"`
+	OccurredAt int64  `json:"occurred_at"`
+}
+
+type webhookDispatcher struct {
+	triggeredLoop
+
+	client *http.Client
+}
+
+var webhooks = &webhookDispatcher{
+	client: newWebhookClient(),
+}
+
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: webhookDialControl}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		// 環境変数のプロキシを経由すると接続先のアドレスを確かめられないので、プロキシは使わない
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: webhookConcurrency,
+		},
+		// リダイレクト先の URL は確かめていないので追わずに失敗とする
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func webhookAllowHTTP() bool {
+	return os.Getenv("ISUCON_WEBHOOK_ALLOW_HTTP") == "1"
+}
+
+// validateWebhookURL は配送先として受け付ける URL かどうかを確かめる
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return errors.New("url must be an absolute https URL")
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if webhookAllowHTTP() {
+			return nil
+		}
+	}
+	return errors.New("url must be an absolute https URL")
+}
+
+// webhookDialControl は名前解決した後の接続先アドレスを確かめる
+// 登録時に確かめても配送時に別のアドレスに解決されうるので、接続の度に確かめる
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := addrPort.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() ||
+		ip.IsMulticast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("%w: %s", errWebhookAddressNotAllowed, ip)
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) Start() {
+	d.backgroundLoop.Start(func(ctx context.Context) {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			d.enqueueLoop(ctx)
+		}()
+		go func() {
+			defer wg.Done()
+			d.loop(ctx, webhookPollInterval, func(ctx context.Context) {
+				if err := d.DeliverOnce(ctx); err != nil && ctx.Err() == nil {
+					slog.Error("failed to deliver webhooks", slog.Any("err", err))
+				}
+			})
+		}()
+		wg.Wait()
+	})
+}
+
+// enqueueLoop は全オーナーのイベントを購読し、登録された Webhook ごとに配送を積む
+func (d *webhookDispatcher) enqueueLoop(ctx context.Context) {
+	for ctx.Err() == nil {
+		statusSub := rideStatusEvents.Subscribe(ownerTopic("*"))
+		activitySub := chairActivityEvents.Subscribe(ownerTopic("*"))
+		d.consume(ctx, statusSub, activitySub)
+		statusSub.Unsubscribe()
+		activitySub.Unsubscribe()
+	}
+}
+
+// consume は購読が打ち切られるか ctx がキャンセルされるまでイベントを積む
+// 打ち切られた間のイベントは通知されない
+func (d *webhookDispatcher) consume(ctx context.Context, statusSub *Subscription[RideStatusEventData], activitySub *Subscription[ChairActivityEventData]) {
+	for {
+		payloads := []webhookPayload{}
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-statusSub.C:
+			if !ok {
+				slog.Warn("webhook subscription for ride statuses was disconnected")
+				return
+			}
+			if e.Data.Status != RideStateCompleted {
+				continue
+			}
+			ride := e.Data.Ride
+			ownerID := strings.TrimPrefix(e.Topic, ownerTopic(""))
+			sale := calculateSale(ride)
+			payloads = append(payloads, webhookPayload{
+				ID:         e.Data.RideStatusID,
+				Type:       webhookEventRideCompleted,
+				OwnerID:    ownerID,
+				ChairID:    ride.ChairID.String,
+				RideID:     ride.ID,
+				Sale:       &sale,
+				OccurredAt: ride.UpdatedAt.UnixMilli(),
+			})
+			if ride.Evaluation != nil {
+				payloads = append(payloads, webhookPayload{
+					ID:         e.Data.RideStatusID + ":evaluated",
+					Type:       webhookEventRideEvaluated,
+					OwnerID:    ownerID,
+					ChairID:    ride.ChairID.String,
+					RideID:     ride.ID,
+					Evaluation: ride.Evaluation,
+					OccurredAt: ride.UpdatedAt.UnixMilli(),
+				})
+			}
+		case e, ok := <-activitySub.C:
+			if !ok {
+				slog.Warn("webhook subscription for chair activities was disconnected")
+				return
+			}
+			active := e.Data.IsActive
+			payloads = append(payloads, webhookPayload{
+				ID:         e.Data.ID,
+				Type:       webhookEventChairActivity,
+				OwnerID:    e.Data.OwnerID,
+				ChairID:    e.Data.ChairID,
+				Active:     &active,
+				OccurredAt: time.Now().UnixMilli(),
+			})
+		}
+
+		for _, p := range payloads {
+			if err := enqueueWebhookDeliveries(ctx, p); err != nil && ctx.Err() == nil {
+				slog.Error("failed to enqueue webhook deliveries", slog.String("event_id", p.ID), slog.Any("err", err))
+			}
+		}
+		d.Trigger()
+	}
+}
+
+// enqueueWebhookDeliveries は p を購読している Webhook ごとに配送を積む
+// 同じイベントが重複して届いても配送は一度だけ積まれる
+func enqueueWebhookDeliveries(ctx context.Context, p webhookPayload) error {
+	hooks := []OwnerWebhook{}
+	if err := db.SelectContext(ctx, &hooks, `SELECT * FROM owner_webhooks WHERE owner_id = ?`, p.OwnerID); err != nil {
+		return err
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		if !slices.Contains(strings.Split(hook.Events, ","), p.Type) {
+			continue
+		}
+		if _, err := db.ExecContext(ctx,
+			`INSERT IGNORE INTO owner_webhook_deliveries (webhook_id, event_id, event_type, payload) VALUES (?, ?, ?, ?)`,
+			hook.ID, p.ID, p.Type, body,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type webhookDeliveryTarget struct {
+	OwnerWebhookDelivery
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+}
+
+// DeliverOnce は配送時刻を迎えた配送を確保し、並行して送る
+func (d *webhookDispatcher) DeliverOnce(ctx context.Context) error {
+	d.runMu.Lock()
+	defer d.runMu.Unlock()
+
+	targets, err := claimWebhookDeliveries(ctx)
+	if err != nil {
+		return err
+	}
+
+	sem := make(chan struct{}, webhookConcurrency)
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			statusCode, err := d.send(ctx, &t)
+			if err := recordWebhookAttempt(ctx, &t, statusCode, err); err != nil && ctx.Err() == nil {
+				slog.Error("failed to record webhook delivery", slog.Int64("delivery_id", t.ID), slog.Any("err", err))
+			}
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// claimWebhookDeliveries は配送時刻を迎えた配送を確保する
+// 複数台で動かしている場合に同じものを同時に送らないよう、送る前に next_attempt_at を先に進めて確保する
+func claimWebhookDeliveries(ctx context.Context) ([]webhookDeliveryTarget, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	targets := []webhookDeliveryTarget{}
+	if err := tx.SelectContext(ctx, &targets, `
+		SELECT d.*, w.url, w.secret
+		FROM owner_webhook_deliveries d
+		         INNER JOIN owner_webhooks w ON w.id = d.webhook_id
+		WHERE d.status = 'PENDING'
+		  AND d.next_attempt_at <= NOW(6)
+		ORDER BY d.next_attempt_at
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED`, webhookBatchSize); err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int64, 0, len(targets))
+	for _, t := range targets {
+		ids = append(ids, t.ID)
+	}
+	query, args, err := sqlx.In(`UPDATE owner_webhook_deliveries SET next_attempt_at = ? WHERE id IN (?)`, time.Now().Add(webhookClaimDuration), ids)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// send は配送を一度だけ試み、受け取ったステータスコードを返す。2xx 以外はエラーとする
+func (d *webhookDispatcher) send(ctx context.Context, t *webhookDeliveryTarget) (int, error) {
+	if err := validateWebhookURL(t.URL); err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(t.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Isuride-Event", t.EventType)
+	req.Header.Set("X-Isuride-Delivery", strconv.FormatInt(t.ID, 10))
+	req.Header.Set("X-Isuride-Timestamp", timestamp)
+	req.Header.Set("X-Isuride-Signature", "sha256="+signWebhookPayload(t.Secret, timestamp, t.Payload))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status code (%d)", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+func signWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff は attempts 回目の失敗の後に次を試すまでの時間
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff << (attempts - 1)
+	if backoff <= 0 || backoff > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+	return backoff
+}
+
+func recordWebhookAttempt(ctx context.Context, t *webhookDeliveryTarget, statusCode int, sendErr error) error {
+	attempts := t.Attempts + 1
+	code := sql.NullInt64{Int64: int64(statusCode), Valid: statusCode != 0}
+
+	if sendErr == nil {
+		_, err := db.ExecContext(ctx,
+			`UPDATE owner_webhook_deliveries SET status = 'SUCCEEDED', attempts = ?, last_status_code = ?, last_error = NULL WHERE id = ?`,
+			attempts, code, t.ID)
+		return err
+	}
+
+	if attempts < webhookMaxAttempts {
+		_, err := db.ExecContext(ctx,
+			`UPDATE owner_webhook_deliveries SET attempts = ?, next_attempt_at = ?, last_status_code = ?, last_error = ? WHERE id = ?`,
+			attempts, time.Now().Add(webhookBackoff(attempts)), code, sendErr.Error(), t.ID)
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE owner_webhook_deliveries SET status = 'DEAD', attempts = ?, last_status_code = ?, last_error = ? WHERE id = ?`,
+		attempts, code, sendErr.Error(), t.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO owner_webhook_dead_letters (delivery_id, webhook_id, event_type, payload, last_error) VALUES (?, ?, ?, ?, ?)`,
+		t.ID, t.WebhookID, t.EventType, t.Payload, sendErr.Error()); err != nil {
+		return err
+	}
+	slog.Warn("webhook delivery moved to dead letters", slog.Int64("delivery_id", t.ID), slog.String("url", t.URL), slog.Any("err", sendErr))
+	return tx.Commit()
+}
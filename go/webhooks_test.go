@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const testWebhookSecret = "test-secret"
+
+// webhookReceiver は受け取ったリクエストの署名を検証し、statuses の順にステータスコードを返す
+// statuses を使い切った後は最後のステータスコードを返し続ける
+type webhookReceiver struct {
+	t        *testing.T
+	mu       sync.Mutex
+	statuses []int
+	received int
+}
+
+func (rc *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rc.t.Errorf("failed to read body: %v", err)
+	}
+
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(r.Header.Get("X-Isuride-Timestamp") + "." + string(body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := r.Header.Get("X-Isuride-Signature"); !hmac.Equal([]byte(got), []byte(want)) {
+		rc.t.Errorf("X-Isuride-Signature = %q, want %q", got, want)
+	}
+
+	rc.mu.Lock()
+	status := rc.statuses[min(rc.received, len(rc.statuses)-1)]
+	rc.received++
+	rc.mu.Unlock()
+	w.WriteHeader(status)
+}
+
+func (rc *webhookReceiver) Received() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.received
+}
+
+func TestWebhookSend(t *testing.T) {
+	receiver := &webhookReceiver{t: t, statuses: []int{http.StatusOK, http.StatusInternalServerError}}
+	srv := httptest.NewTLSServer(receiver)
+	defer srv.Close()
+
+	d := &webhookDispatcher{client: srv.Client()}
+	target := &webhookDeliveryTarget{
+		OwnerWebhookDelivery: OwnerWebhookDelivery{ID: 1, EventType: webhookEventRideCompleted, Payload: []byte(`{"id":"event"}`)},
+		URL:                  srv.URL,
+		Secret:               testWebhookSecret,
+	}
+
+	if code, err := d.send(context.Background(), target); err != nil || code != http.StatusOK {
+		t.Errorf("send() = %d, %v, want 200, nil", code, err)
+	}
+	if code, err := d.send(context.Background(), target); err == nil || code != http.StatusInternalServerError {
+		t.Errorf("send() = %d, %v, want 500 and an error", code, err)
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		url       string
+		allowHTTP bool
+		wantErr   bool
+	}{
+		{url: "https://example.com/hook"},
+		{url: "http://example.com/hook", wantErr: true},
+		{url: "http://example.com/hook", allowHTTP: true},
+		{url: "ftp://example.com/hook", allowHTTP: true, wantErr: true},
+		{url: "/hook", wantErr: true},
+		{url: "https://", wantErr: true},
+	}
+	for _, tt := range tests {
+		if tt.allowHTTP {
+			t.Setenv("ISUCON_WEBHOOK_ALLOW_HTTP", "1")
+		} else {
+			t.Setenv("ISUCON_WEBHOOK_ALLOW_HTTP", "")
+		}
+		if err := validateWebhookURL(tt.url); (err != nil) != tt.wantErr {
+			t.Errorf("validateWebhookURL(%q) with allowHTTP=%v = %v, wantErr %v", tt.url, tt.allowHTTP, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWebhookDialControl(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"127.0.0.1:443", false},
+		{"[::1]:443", false},
+		{"10.0.0.1:443", false},
+		{"172.16.0.1:443", false},
+		{"192.168.1.1:443", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:443", false},
+		{"[fd00::1]:443", false},
+		{"0.0.0.0:443", false},
+		{"[::ffff:127.0.0.1]:443", false},
+		{"224.0.0.1:443", false},
+	}
+	for _, tt := range tests {
+		err := webhookDialControl("tcp", tt.address, nil)
+		if tt.allowed && err != nil {
+			t.Errorf("webhookDialControl(%s) = %v, want nil", tt.address, err)
+		}
+		if !tt.allowed && !errors.Is(err, errWebhookAddressNotAllowed) {
+			t.Errorf("webhookDialControl(%s) = %v, want errWebhookAddressNotAllowed", tt.address, err)
+		}
+	}
+}
+
+func TestWebhookClientRejectsLoopback(t *testing.T) {
+	receiver := &webhookReceiver{t: t, statuses: []int{http.StatusOK}}
+	srv := httptest.NewTLSServer(receiver)
+	defer srv.Close()
+
+	d := &webhookDispatcher{client: newWebhookClient()}
+	target := &webhookDeliveryTarget{
+		OwnerWebhookDelivery: OwnerWebhookDelivery{ID: 1, EventType: webhookEventRideCompleted, Payload: []byte(`{"id":"event"}`)},
+		URL:                  srv.URL,
+		Secret:               testWebhookSecret,
+	}
+	if _, err := d.send(context.Background(), target); !errors.Is(err, errWebhookAddressNotAllowed) {
+		t.Errorf("send() = %v, want errWebhookAddressNotAllowed", err)
+	}
+	if got := receiver.Received(); got != 0 {
+		t.Errorf("received %d requests, want 0", got)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, webhookBaseBackoff},
+		{2, 2 * webhookBaseBackoff},
+		{4, 8 * webhookBaseBackoff},
+		{20, webhookMaxBackoff},
+		{100, webhookMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// insertTestWebhookDelivery は url 宛ての Webhook と配送を登録し、配送IDを返す
+func insertTestWebhookDelivery(t *testing.T, url string) int64 {
+	t.Helper()
+	ctx := context.Background()
+
+	webhookID := ulid.Make().String()
+	if _, err := db.ExecContext(ctx,
+		`INSERT INTO owner_webhooks (id, owner_id, url, secret, events) VALUES (?, ?, ?, ?, ?)`,
+		webhookID, ulid.Make().String(), url, testWebhookSecret, webhookEventRideCompleted,
+	); err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.ExecContext(ctx,
+		`INSERT INTO owner_webhook_deliveries (webhook_id, event_id, event_type, payload) VALUES (?, ?, ?, ?)`,
+		webhookID, ulid.Make().String(), webhookEventRideCompleted, `{"type":"ride.completed"}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveryID, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.ExecContext(ctx, `DELETE FROM owner_webhook_dead_letters WHERE delivery_id = ?`, deliveryID)
+		db.ExecContext(ctx, `DELETE FROM owner_webhook_deliveries WHERE id = ?`, deliveryID)
+		db.ExecContext(ctx, `DELETE FROM owner_webhooks WHERE id = ?`, webhookID)
+	})
+	return deliveryID
+}
+
+func getTestWebhookDelivery(t *testing.T, deliveryID int64) OwnerWebhookDelivery {
+	t.Helper()
+	delivery := OwnerWebhookDelivery{}
+	if err := db.GetContext(context.Background(), &delivery, `SELECT * FROM owner_webhook_deliveries WHERE id = ?`, deliveryID); err != nil {
+		t.Fatal(err)
+	}
+	return delivery
+}
+
+// deliverNow はバックオフを待たずに配送させる
+func deliverNow(t *testing.T, d *webhookDispatcher, deliveryID int64) {
+	t.Helper()
+	if _, err := db.ExecContext(context.Background(), `UPDATE owner_webhook_deliveries SET next_attempt_at = NOW(6) WHERE id = ?`, deliveryID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeliverOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeliverOnceRetriesAfterServerError(t *testing.T) {
+	setupTestDB(t)
+
+	receiver := &webhookReceiver{t: t, statuses: []int{http.StatusInternalServerError, http.StatusOK}}
+	srv := httptest.NewTLSServer(receiver)
+	defer srv.Close()
+	d := &webhookDispatcher{client: srv.Client()}
+	deliveryID := insertTestWebhookDelivery(t, srv.URL)
+
+	start := time.Now()
+	if err := d.DeliverOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	delivery := getTestWebhookDelivery(t, deliveryID)
+	if delivery.Status != "PENDING" || delivery.Attempts != 1 || delivery.LastStatusCode.Int64 != http.StatusInternalServerError {
+		t.Fatalf("after a 500: status = %s, attempts = %d, last_status_code = %v", delivery.Status, delivery.Attempts, delivery.LastStatusCode)
+	}
+	// 次の配送はバックオフの後になる
+	if earliest := start.Add(webhookBackoff(1)); delivery.NextAttemptAt.Before(earliest.Add(-time.Second)) {
+		t.Errorf("next_attempt_at = %v, want after %v", delivery.NextAttemptAt, earliest)
+	}
+	if err := d.DeliverOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiver.Received(); got != 1 {
+		t.Fatalf("received %d requests before the backoff elapsed, want 1", got)
+	}
+
+	deliverNow(t, d, deliveryID)
+	delivery = getTestWebhookDelivery(t, deliveryID)
+	if delivery.Status != "SUCCEEDED" || delivery.Attempts != 2 || delivery.LastError.Valid {
+		t.Errorf("after a 200: status = %s, attempts = %d, last_error = %v", delivery.Status, delivery.Attempts, delivery.LastError)
+	}
+}
+
+func TestDeliverOnceMovesToDeadLetters(t *testing.T) {
+	setupTestDB(t)
+
+	receiver := &webhookReceiver{t: t, statuses: []int{http.StatusInternalServerError}}
+	srv := httptest.NewTLSServer(receiver)
+	defer srv.Close()
+	d := &webhookDispatcher{client: srv.Client()}
+	deliveryID := insertTestWebhookDelivery(t, srv.URL)
+
+	for range webhookMaxAttempts {
+		deliverNow(t, d, deliveryID)
+	}
+	if got := receiver.Received(); got != webhookMaxAttempts {
+		t.Errorf("received %d requests, want %d", got, webhookMaxAttempts)
+	}
+
+	delivery := getTestWebhookDelivery(t, deliveryID)
+	if delivery.Status != "DEAD" || delivery.Attempts != webhookMaxAttempts {
+		t.Errorf("status = %s, attempts = %d, want DEAD, %d", delivery.Status, delivery.Attempts, webhookMaxAttempts)
+	}
+	deadLetters := 0
+	if err := db.GetContext(context.Background(), &deadLetters, `SELECT COUNT(*) FROM owner_webhook_dead_letters WHERE delivery_id = ?`, deliveryID); err != nil {
+		t.Fatal(err)
+	}
+	if deadLetters != 1 {
+		t.Errorf("dead letters = %d, want 1", deadLetters)
+	}
+
+	// DEAD になった配送はもう送らない
+	deliverNow(t, d, deliveryID)
+	if got := receiver.Received(); got != webhookMaxAttempts {
+		t.Errorf("received %d requests after moving to dead letters, want %d", got, webhookMaxAttempts)
+	}
+}
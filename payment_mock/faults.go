@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Faults は POST /payments に注入する障害の設定
+// 確率は 0 から 1 で指定し、1 にすると必ず発生する
+type Faults struct {
+	// 決済を記録した後に 500 を返す確率
+	ErrorAfterRecord float64 `json:"error_after_record"`
+	// 決済を記録せずに 500 を返す確率
+	ErrorBeforeRecord float64 `json:"error_before_record"`
+	// 決済を記録するまでにかける時間(ミリ秒)
+	LatencyMs int `json:"latency_ms"`
+	// 同時に処理するリクエストがこの数を超えたら 503 を返す。0 なら制限しない
+	MaxConcurrency int `json:"max_concurrency"`
+	// 決済を記録した後にレスポンスを返さずに接続を切る確率
+	DropConnection float64 `json:"drop_connection"`
+}
+
+var (
+	faults     Faults
+	faultsLock sync.RWMutex
+
+	inFlight atomic.Int64
+)
+
+// registerFaultFlags は起動時の障害の設定をフラグから読み込めるようにする
+func registerFaultFlags(fs *flag.FlagSet) {
+	fs.Float64Var(&faults.ErrorAfterRecord, "error-after-record", 0, "probability of responding 500 after recording the payment")
+	fs.Float64Var(&faults.ErrorBeforeRecord, "error-before-record", 0, "probability of responding 500 without recording the payment")
+	fs.IntVar(&faults.LatencyMs, "latency-ms", 0, "latency added before recording the payment, in milliseconds")
+	fs.IntVar(&faults.MaxConcurrency, "max-concurrency", 0, "respond 503 when more requests than this are in flight (0: unlimited)")
+	fs.Float64Var(&faults.DropConnection, "drop-connection", 0, "probability of dropping the connection after recording the payment")
+}
+
+func currentFaults() Faults {
+	faultsLock.RLock()
+	defer faultsLock.RUnlock()
+	return faults
+}
+
+func roll(probability float64) bool {
+	return probability > 0 && rand.Float64() < probability
+}
+
+func handleGetFaults(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentFaults())
+}
+
+// 障害の設定を丸ごと置き換える。{} を送ると障害なしに戻る
+func handlePostFaults(w http.ResponseWriter, r *http.Request) {
+	var req Faults
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "不正なリクエスト形式です"})
+		return
+	}
+
+	faultsLock.Lock()
+	faults = req
+	faultsLock.Unlock()
+
+	writeJSON(w, http.StatusOK, req)
+}
+
+// dropConnection はレスポンスを返さずに接続を切る
+func dropConnection(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
+
+func sleepLatency(f Faults) {
+	if f.LatencyMs > 0 {
+		time.Sleep(time.Duration(f.LatencyMs) * time.Millisecond)
+	}
+}
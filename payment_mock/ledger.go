@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Payment は台帳に記録された決済
+type Payment struct {
+	ID             string    `json:"id"`
+	Amount         int       `json:"amount"`
+	Status         string    `json:"status"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	Refunds        []Refund  `json:"refunds,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type Refund struct {
+	IdempotencyKey string    `json:"idempotency_key"`
+	Amount         int       `json:"amount"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (p *Payment) refunded() int {
+	sum := 0
+	for _, r := range p.Refunds {
+		sum += r.Amount
+	}
+	return sum
+}
+
+var errRefundExceedsPayment = errors.New("返金額が決済額を超えています")
+
+// ledger はトークンごとの決済の台帳
+// path を指定した場合は変更のたびに JSON ファイルに書き出し、起動時に読み込む
+type ledger struct {
+	mu       sync.Mutex
+	payments map[string][]*Payment
+	path     string
+}
+
+func newLedger(path string) (*ledger, error) {
+	l := &ledger{
+		payments: map[string][]*Payment{},
+		path:     path,
+	}
+	if path == "" {
+		return l, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &l.payments); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Record は決済を台帳に記録する
+func (l *ledger) Record(token string, amount int, idempotencyKey string) (*Payment, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p := &Payment{
+		ID:             newPaymentID(),
+		Amount:         amount,
+		Status:         "成功",
+		IdempotencyKey: idempotencyKey,
+		CreatedAt:      time.Now(),
+	}
+	l.payments[token] = append(l.payments[token], p)
+	return p, l.save()
+}
+
+// Find は決済IDまたは Idempotency-Key で決済を探す
+func (l *ledger) Find(token string, id string) (*Payment, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, p := range l.payments[token] {
+		if p.ID == id || (p.IdempotencyKey != "" && p.IdempotencyKey == id) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Refund は決済の一部または全部を返金する。同じ Idempotency-Key の返金があればそれを返す
+func (l *ledger) Refund(p *Payment, idempotencyKey string, amount int) (Refund, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, r := range p.Refunds {
+		if r.IdempotencyKey == idempotencyKey {
+			return r, true, nil
+		}
+	}
+	if p.refunded()+amount > p.Amount {
+		return Refund{}, false, errRefundExceedsPayment
+	}
+
+	r := Refund{
+		IdempotencyKey: idempotencyKey,
+		Amount:         amount,
+		CreatedAt:      time.Now(),
+	}
+	p.Refunds = append(p.Refunds, r)
+	return r, false, l.save()
+}
+
+// List は token の決済を記録した順に返す。after を指定した場合はその決済IDより後の決済を返す
+// limit が 0 の場合は全て返す。続きがある場合は次に after に指定する決済IDを返す
+func (l *ledger) List(token string, after string, limit int) ([]Payment, string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	payments := l.payments[token]
+	start := 0
+	if after != "" {
+		start = -1
+		for i, p := range payments {
+			if p.ID == after {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			return nil, "", false
+		}
+	}
+	end := len(payments)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+
+	res := make([]Payment, 0, end-start)
+	for _, p := range payments[start:end] {
+		res = append(res, *p)
+	}
+	next := ""
+	if end < len(payments) {
+		next = payments[end-1].ID
+	}
+	return res, next, true
+}
+
+// Each は全ての決済を呼び出す。起動時に Idempotency-Key を復元するのに使う
+func (l *ledger) Each(f func(token string, p *Payment)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for token, payments := range l.payments {
+		for _, p := range payments {
+			f(token, p)
+		}
+	}
+}
+
+// save は台帳を一時ファイルに書き出してから置き換える。l.mu を持った状態で呼ぶこと
+func (l *ledger) save() error {
+	if l.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(l.payments)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path)
+}
+
+func newPaymentID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return "pay_" + hex.EncodeToString(b)
+}
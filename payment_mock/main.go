@@ -2,23 +2,59 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 )
 
 var (
-	data     = map[string][]int{}
-	dataLock sync.Mutex
+	payments *ledger
+
+	// トークンごとの Idempotency-Key とその決済
+	idempotencyKeys     = map[string]map[string]*idempotentPayment{}
+	idempotencyKeysLock sync.Mutex
 )
 
+type idempotentPayment struct {
+	amount     int
+	inProgress bool
+}
+
 func main() {
+	addr := flag.String("addr", ":12345", "listen address")
+	ledgerPath := flag.String("ledger", "", "JSON file to persist the ledger across restarts (default: in memory only)")
+	registerFaultFlags(flag.CommandLine)
+	flag.Parse()
+
+	var err error
+	payments, err = newLedger(*ledgerPath)
+	if err != nil {
+		slog.Error("failed to load ledger", slog.String("path", *ledgerPath), slog.Any("err", err))
+		os.Exit(1)
+	}
+	// 再起動しても同じ Idempotency-Key の決済が二重に行われないよう、台帳から復元する
+	payments.Each(func(token string, p *Payment) {
+		if p.IdempotencyKey == "" {
+			return
+		}
+		if _, ok := idempotencyKeys[token]; !ok {
+			idempotencyKeys[token] = map[string]*idempotentPayment{}
+		}
+		idempotencyKeys[token][p.IdempotencyKey] = &idempotentPayment{amount: p.Amount}
+	})
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /payments", handleGetPayments)
 	mux.HandleFunc("POST /payments", handlePostPayments)
-	http.ListenAndServe(":12345", mux)
+	mux.HandleFunc("POST /payments/{id}/refund", handlePostRefund)
+	mux.HandleFunc("GET /_control/faults", handleGetFaults)
+	mux.HandleFunc("POST /_control/faults", handlePostFaults)
+	http.ListenAndServe(*addr, mux)
 }
 
 type PostPaymentsRequest struct {
@@ -43,25 +79,88 @@ func handlePostPayments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	f := currentFaults()
+	if n := inFlight.Add(1); f.MaxConcurrency > 0 && n > int64(f.MaxConcurrency) {
+		inFlight.Add(-1)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"message": "同時に処理できる決済の数を超えました"})
+		return
+	}
+	defer inFlight.Add(-1)
+
+	if roll(f.ErrorBeforeRecord) {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済に失敗しました"})
+		return
+	}
+
+	// Idempotency-Key が指定された場合は、同じトークンとキーの決済を一度しか行わない
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" {
+		idempotencyKeysLock.Lock()
+		keys, ok := idempotencyKeys[token]
+		if !ok {
+			keys = map[string]*idempotentPayment{}
+			idempotencyKeys[token] = keys
+		}
+		if p, ok := keys[key]; ok {
+			idempotencyKeysLock.Unlock()
+			if p.inProgress {
+				writeJSON(w, http.StatusConflict, map[string]string{"message": "同じkeyでの決済が実行中です"})
+				return
+			}
+			if p.amount != req.Amount {
+				writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "同じkeyで異なる決済額が指定されました"})
+				return
+			}
+			slog.Info("決済済み", slog.String("token", token), slog.String("idempotency_key", key), slog.Int("amount", req.Amount))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		p := &idempotentPayment{amount: req.Amount, inProgress: true}
+		keys[key] = p
+		idempotencyKeysLock.Unlock()
+
+		defer func() {
+			idempotencyKeysLock.Lock()
+			p.inProgress = false
+			idempotencyKeysLock.Unlock()
+		}()
+	}
+
+	sleepLatency(f)
+
 	// モックサーバーは任意のトークンを受け付けて、決済を記録する
-	dataLock.Lock()
-	arr, ok := data[token]
-	if !ok {
-		arr = []int{}
-		data[token] = arr
+	payment, err := payments.Record(token, req.Amount, key)
+	if err != nil {
+		slog.Error("台帳の保存に失敗しました", slog.Any("err", err))
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済の記録に失敗しました"})
+		return
 	}
-	arr = append(arr, req.Amount)
-	dataLock.Unlock()
 
-	slog.Info("決済完了", slog.String("token", token), slog.Int("amount", req.Amount))
+	slog.Info("決済完了", slog.String("token", token), slog.String("id", payment.ID), slog.Int("amount", req.Amount))
+
+	// 決済は記録されているが、クライアントには成功したことが伝わらない
+	if roll(f.DropConnection) {
+		dropConnection(w)
+		return
+	}
+	if roll(f.ErrorAfterRecord) {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済に失敗しました"})
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
 type ResponsePayment struct {
-	Amount int    `json:"amount"`
-	Status string `json:"status"`
+	ID             string `json:"id"`
+	Amount         int    `json:"amount"`
+	Status         string `json:"status"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	RefundedAmount int    `json:"refunded_amount"`
+	CreatedAt      int64  `json:"created_at"`
 }
 
+// handleGetPayments はトークンの決済を記録した順に返す
+// limit を指定した場合はその件数ずつ返し、続きがあれば X-Next-Cursor を次の after に指定する
 func handleGetPayments(w http.ResponseWriter, r *http.Request) {
 	token, err := getTokenFromAuthorizationHeader(r)
 	if err != nil {
@@ -69,17 +168,35 @@ func handleGetPayments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dataLock.Lock()
-	arr, _ := data[token]
-	dataLock.Unlock()
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": "limitが不正です"})
+			return
+		}
+	}
 
-	res := make([]ResponsePayment, 0, len(arr))
-	for _, amount := range arr {
+	list, next, ok := payments.List(token, r.URL.Query().Get("after"), limit)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "afterに指定された決済が見つかりません"})
+		return
+	}
+
+	res := make([]ResponsePayment, 0, len(list))
+	for _, p := range list {
 		res = append(res, ResponsePayment{
-			Amount: amount,
-			Status: "成功",
+			ID:             p.ID,
+			Amount:         p.Amount,
+			Status:         p.Status,
+			IdempotencyKey: p.IdempotencyKey,
+			RefundedAmount: p.refunded(),
+			CreatedAt:      p.CreatedAt.UnixMilli(),
 		})
 	}
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
 	writeJSON(w, http.StatusOK, res)
 }
 
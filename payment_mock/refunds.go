@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+type PostRefundRequest struct {
+	Amount int `json:"amount"`
+}
+
+// handlePostRefund は {id} の決済の一部または全部を返金する。{id} には決済IDか決済の Idempotency-Key を指定する
+// 返金の Idempotency-Key は必須で、同じキーの返金は一度しか行わない
+func handlePostRefund(w http.ResponseWriter, r *http.Request) {
+	token, err := getTokenFromAuthorizationHeader(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Idempotency-Keyが指定されていません"})
+		return
+	}
+
+	var req PostRefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "不正なリクエスト形式です"})
+		return
+	}
+	if req.Amount <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "返金額が不正です"})
+		return
+	}
+
+	p, ok := payments.Find(token, r.PathValue("id"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "決済が見つかりません"})
+		return
+	}
+
+	refund, replayed, err := payments.Refund(p, key, req.Amount)
+	if errors.Is(err, errRefundExceedsPayment) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	if err != nil {
+		slog.Error("台帳の保存に失敗しました", slog.Any("err", err))
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "返金の記録に失敗しました"})
+		return
+	}
+	if replayed && refund.Amount != req.Amount {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "同じkeyで異なる返金額が指定されました"})
+		return
+	}
+
+	if !replayed {
+		slog.Info("返金完了", slog.String("token", token), slog.String("payment", p.ID), slog.Int("amount", req.Amount))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
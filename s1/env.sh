@@ -7,4 +7,7 @@ ISUCON_DB_NAME="isuride"
 # マッチング間隔（秒）
 ISUCON_MATCHING_INTERVAL=0.01
 
+# イベントの配送方式 (memory / mysql)。複数台でアプリケーションを動かす場合は mysql にする
+ISUCON_EVENT_BACKEND=memory
+
 SERVER_ID=s1
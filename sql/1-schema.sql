@@ -100,6 +100,46 @@ CREATE TABLE payment_tokens
   PRIMARY KEY (user_id)
 )
   COMMENT = '決済トークンテーブル';
+-- 初期データの投入後に 4-migrations.sql で id, is_default を追加し、利用者ごとに複数登録できるようにする
+
+DROP TABLE IF EXISTS payments;
+CREATE TABLE payments
+(
+  ride_id         VARCHAR(26)  NOT NULL COMMENT 'ライドID(決済のIdempotency-Key)',
+  user_id         VARCHAR(26)  NOT NULL COMMENT 'ユーザーID',
+  amount          INTEGER      NOT NULL COMMENT '決済額',
+  status          ENUM ('PENDING', 'SUCCEEDED', 'PAYMENT_FAILED') NOT NULL COMMENT '決済の状態',
+  attempts        INTEGER      NOT NULL DEFAULT 0 COMMENT '決済を試みた回数',
+  next_attempt_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '次に決済を試みる日時',
+  last_error      TEXT         NULL COMMENT '最後の決済エラー',
+  token           VARCHAR(255) NULL COMMENT '最後に決済を送った決済トークン。拒否された場合は消す',
+  created_at      DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  updated_at      DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (ride_id),
+  INDEX idx_user_id (user_id),
+  INDEX idx_status_next_attempt_at (status, next_attempt_at)
+)
+  COMMENT = 'ライドごとの決済テーブル';
+
+DROP TABLE IF EXISTS refunds;
+CREATE TABLE refunds
+(
+  id              VARCHAR(26)  NOT NULL COMMENT '返金ID(返金のIdempotency-Key)',
+  ride_id         VARCHAR(26)  NOT NULL COMMENT '返金する決済のライドID',
+  amount          INTEGER      NOT NULL COMMENT '返金額',
+  reason          TEXT         NOT NULL COMMENT '返金理由',
+  requested_by    ENUM ('OWNER', 'ADMIN') NOT NULL COMMENT '返金を行った者',
+  status          ENUM ('PENDING', 'SUCCEEDED', 'FAILED') NOT NULL COMMENT '返金の状態',
+  attempts        INTEGER      NOT NULL DEFAULT 0 COMMENT '返金を試みた回数',
+  next_attempt_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '次に返金を試みる日時',
+  last_error      TEXT         NULL COMMENT '返金エラー',
+  created_at      DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  updated_at      DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id),
+  INDEX idx_ride_id (ride_id),
+  INDEX idx_status_next_attempt_at (status, next_attempt_at)
+)
+  COMMENT = '決済の返金テーブル';
 
 DROP TABLE IF EXISTS rides;
 CREATE TABLE rides
@@ -125,7 +165,7 @@ CREATE TABLE ride_statuses
 (
   id              VARCHAR(26)                                                                NOT NULL,
   ride_id VARCHAR(26)                                                                        NOT NULL COMMENT 'ライドID',
-  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED') NOT NULL COMMENT '状態',
+  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED') NOT NULL COMMENT '状態',
   created_at      DATETIME(6)                                                                NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '状態変更日時',
   app_sent_at     DATETIME(6)                                                                NULL COMMENT 'ユーザーへの状態通知日時',
   chair_sent_at   DATETIME(6)                                                                NULL COMMENT '椅子への状態通知日時',
@@ -134,6 +174,53 @@ CREATE TABLE ride_statuses
   COMMENT = 'ライドステータスの変更履歴テーブル';
 ALTER TABLE ride_statuses ADD INDEX idx_ride_id_created_at_desc (ride_id, created_at DESC);
 
+DROP TABLE IF EXISTS ride_cancellations;
+CREATE TABLE ride_cancellations
+(
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  status     VARCHAR(30) NOT NULL COMMENT 'キャンセル時点のライドの状態',
+  fee        INTEGER     NOT NULL COMMENT 'キャンセル料',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT 'キャンセル日時',
+  PRIMARY KEY (ride_id)
+)
+  COMMENT = 'ライドのキャンセル情報テーブル';
+
+DROP TABLE IF EXISTS ride_rejections;
+CREATE TABLE ride_rejections
+(
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  chair_id   VARCHAR(26) NOT NULL COMMENT '割り当てを辞退した椅子ID',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '辞退日時',
+  PRIMARY KEY (ride_id, chair_id)
+)
+  COMMENT = '椅子が辞退したライドの割り当て履歴テーブル';
+
+DROP TABLE IF EXISTS ride_event_outbox;
+CREATE TABLE ride_event_outbox
+(
+  id           BIGINT       NOT NULL AUTO_INCREMENT COMMENT 'ID',
+  topic        VARCHAR(255) NOT NULL COMMENT '通知先のトピック',
+  payload      JSON         NOT NULL COMMENT '通知内容',
+  created_at   DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  delivered_at DATETIME(6)  NULL COMMENT 'EventBusに配送した日時',
+  PRIMARY KEY (id),
+  INDEX idx_delivered_at (delivered_at)
+)
+  COMMENT = 'ライドのイベントのアウトボックステーブル';
+
+DROP TABLE IF EXISTS bus_events;
+CREATE TABLE bus_events
+(
+  id         BIGINT       NOT NULL AUTO_INCREMENT COMMENT 'ID',
+  bus        VARCHAR(64)  NOT NULL COMMENT 'EventBusの名前',
+  topic      VARCHAR(255) NOT NULL COMMENT 'トピック',
+  payload    JSON         NOT NULL COMMENT 'イベントの内容',
+  created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '発生日時',
+  PRIMARY KEY (id),
+  INDEX idx_created_at (created_at)
+)
+  COMMENT = 'アプリケーション間で共有するイベントのテーブル';
+
 DROP TABLE IF EXISTS owners;
 CREATE TABLE owners
 (
@@ -150,6 +237,54 @@ CREATE TABLE owners
 )
   COMMENT = '椅子のオーナー情報テーブル';
 
+DROP TABLE IF EXISTS owner_webhooks;
+CREATE TABLE owner_webhooks
+(
+  id         VARCHAR(26)   NOT NULL COMMENT 'WebhookID',
+  owner_id   VARCHAR(26)   NOT NULL COMMENT 'オーナーID',
+  url        VARCHAR(2048) NOT NULL COMMENT '通知先URL',
+  secret     VARCHAR(255)  NOT NULL COMMENT '署名用のシークレット',
+  events     VARCHAR(255)  NOT NULL COMMENT '通知するイベントの種類(カンマ区切り)',
+  created_at DATETIME(6)   NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id),
+  INDEX idx_owner_id (owner_id)
+)
+  COMMENT = 'オーナーのWebhook登録テーブル';
+
+DROP TABLE IF EXISTS owner_webhook_deliveries;
+CREATE TABLE owner_webhook_deliveries
+(
+  id               BIGINT      NOT NULL AUTO_INCREMENT COMMENT 'ID',
+  webhook_id       VARCHAR(26) NOT NULL COMMENT 'WebhookID',
+  event_id         VARCHAR(64) NOT NULL COMMENT 'イベントID',
+  event_type       VARCHAR(64) NOT NULL COMMENT 'イベントの種類',
+  payload          JSON        NOT NULL COMMENT '送信する内容',
+  status           ENUM ('PENDING', 'SUCCEEDED', 'DEAD') NOT NULL DEFAULT 'PENDING' COMMENT '配送状況',
+  attempts         INTEGER     NOT NULL DEFAULT 0 COMMENT '試行回数',
+  next_attempt_at  DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '次に配送を試みる日時',
+  last_status_code INTEGER     NULL COMMENT '最後に受け取ったステータスコード',
+  last_error       TEXT        NULL COMMENT '最後の配送エラー',
+  created_at       DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  updated_at       DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id),
+  UNIQUE (webhook_id, event_id),
+  INDEX idx_status_next_attempt_at (status, next_attempt_at)
+)
+  COMMENT = 'Webhookの配送履歴テーブル';
+
+DROP TABLE IF EXISTS owner_webhook_dead_letters;
+CREATE TABLE owner_webhook_dead_letters
+(
+  delivery_id BIGINT      NOT NULL COMMENT '配送ID',
+  webhook_id  VARCHAR(26) NOT NULL COMMENT 'WebhookID',
+  event_type  VARCHAR(64) NOT NULL COMMENT 'イベントの種類',
+  payload     JSON        NOT NULL COMMENT '送信できなかった内容',
+  last_error  TEXT        NULL COMMENT '最後の配送エラー',
+  created_at  DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (delivery_id)
+)
+  COMMENT = '配送をあきらめたWebhookのテーブル';
+
 DROP TABLE IF EXISTS coupons;
 CREATE TABLE coupons
 (
@@ -161,4 +296,30 @@ CREATE TABLE coupons
   PRIMARY KEY (user_id, code)
 )
   COMMENT 'クーポンテーブル';
-ALTER TABLE coupons ADD INDEX idx_used_by (used_by);
\ No newline at end of file
+-- 初期データの投入後に 4-migrations.sql で割引の種類などを追加する
+ALTER TABLE coupons ADD INDEX idx_used_by (used_by);
+
+DROP TABLE IF EXISTS coupon_campaigns;
+CREATE TABLE coupon_campaigns
+(
+  id                  VARCHAR(26)  NOT NULL COMMENT 'キャンペーンID',
+  code_prefix         VARCHAR(255) NOT NULL COMMENT 'クーポンコードのプレフィックス',
+  grant_on            ENUM ('SIGNUP', 'INVITATION', 'INVITER_REWARD') NOT NULL COMMENT 'クーポンを付与する契機',
+  discount            INTEGER      NOT NULL COMMENT '割引額(discount_type が PERCENT の場合は割引率%)',
+  discount_type       ENUM ('AMOUNT', 'PERCENT') NOT NULL DEFAULT 'AMOUNT' COMMENT '割引の種類',
+  max_discount        INTEGER      NULL COMMENT '割引額の上限',
+  min_fare            INTEGER      NULL COMMENT 'クーポンを使える割引前の運賃の下限',
+  applies_to          ENUM ('METERED', 'TOTAL') NOT NULL DEFAULT 'METERED' COMMENT '割引の対象(METERED: 距離に応じた運賃のみ, TOTAL: 初乗り運賃を含む)',
+  eligibility         ENUM ('ANY_RIDE', 'FIRST_RIDE_ONLY') NOT NULL DEFAULT 'ANY_RIDE' COMMENT 'クーポンを使えるライド',
+  priority            INTEGER      NOT NULL DEFAULT 0 COMMENT '大きいほど先に使われる',
+  starts_at           DATETIME(6)  NULL COMMENT '開始日時',
+  ends_at             DATETIME(6)  NULL COMMENT '終了日時',
+  max_redemptions     INTEGER      NULL COMMENT '利用回数の上限',
+  max_grants_per_code INTEGER      NULL COMMENT '同じコードのクーポンを付与できる数の上限',
+  redemptions         INTEGER      NOT NULL DEFAULT 0 COMMENT '利用回数',
+  created_at          DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '作成日時',
+  updated_at          DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id),
+  UNIQUE KEY uniq_code_prefix (code_prefix)
+)
+  COMMENT = 'クーポンキャンペーンテーブル';
\ No newline at end of file
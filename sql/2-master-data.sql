@@ -4,7 +4,13 @@ SET CHARACTER_SET_CONNECTION = utf8mb4;
 USE isuride;
 
 INSERT INTO settings (name, value)
-VALUES ('payment_gateway_url', 'http://localhost:12345');
+VALUES ('payment_gateway_url', 'http://localhost:12345'),
+       ('matching_strategy', 'optimal');
+
+INSERT INTO coupon_campaigns (id, code_prefix, grant_on, discount, priority, max_grants_per_code)
+VALUES ('01JDJ00000000000000000SGNP', 'CP_NEW2024', 'SIGNUP', 3000, 1, NULL),
+       ('01JDJ00000000000000000NVTN', 'INV_', 'INVITATION', 1500, 0, 3),
+       ('01JDJ00000000000000000RWRD', 'RWD_', 'INVITER_REWARD', 1000, 0, NULL);
 
 INSERT INTO chair_models (name, speed)
 VALUES ('リラックスシート NEO', 2),
@@ -0,0 +1,22 @@
+-- 3-initial-data.sql.gz はカラムを指定せずに INSERT しているので、初期データを投入した後にテーブルを変更する
+
+-- 利用者ごとに複数の決済トークンを登録できるようにする
+-- 初期データの決済トークンはユーザーIDをIDとし、既定の決済トークンとする
+ALTER TABLE payment_tokens
+  ADD COLUMN id         VARCHAR(26) NULL COMMENT '決済トークンID' FIRST,
+  ADD COLUMN is_default TINYINT(1)  NOT NULL DEFAULT 0 COMMENT '既定の決済トークンかどうか' AFTER token;
+UPDATE payment_tokens SET id = user_id, is_default = 1;
+ALTER TABLE payment_tokens
+  MODIFY COLUMN id VARCHAR(26) NOT NULL COMMENT '決済トークンID',
+  DROP PRIMARY KEY,
+  ADD PRIMARY KEY (id),
+  ADD UNIQUE KEY uniq_user_id_token (user_id, token);
+
+-- クーポンに割引率、割引額の上限、運賃の下限、初乗り運賃を含めた割引を指定できるようにする
+-- 初期データのクーポンはこれまで通り、距離に応じた運賃から定額を割り引く
+ALTER TABLE coupons
+  MODIFY COLUMN discount      INTEGER NOT NULL COMMENT '割引額(discount_type が PERCENT の場合は割引率%)',
+  ADD COLUMN    discount_type ENUM ('AMOUNT', 'PERCENT') NOT NULL DEFAULT 'AMOUNT' COMMENT '割引の種類' AFTER discount,
+  ADD COLUMN    max_discount  INTEGER NULL COMMENT '割引額の上限' AFTER discount_type,
+  ADD COLUMN    min_fare      INTEGER NULL COMMENT 'クーポンを使える割引前の運賃の下限' AFTER max_discount,
+  ADD COLUMN    applies_to    ENUM ('METERED', 'TOTAL') NOT NULL DEFAULT 'METERED' COMMENT '割引の対象(METERED: 距離に応じた運賃のみ, TOTAL: 初乗り運賃を含む)' AFTER min_fare;